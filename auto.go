@@ -0,0 +1,58 @@
+package main
+
+// values must drop this much below the limits before speed is reverted,
+// so that speed does not toggle when value hovers around the limit
+const (
+	autoCo2Hysteresis = 100
+	autoRhHysteresis  = 5
+)
+
+var (
+	autoActive      bool
+	autoRevertSpeed byte
+)
+
+// autoSpeedEnabled returns true if at least one limit for automatic speed is configured
+func autoSpeedEnabled() bool {
+	return config.AutoCo2Limit > 0 || config.AutoRhLimit > 0
+}
+
+// checkAutoSpeed raises speed to AutoSpeed when co2 or humidity exceeds the configured
+// limit and reverts to the previous speed when both are back to normal
+func checkAutoSpeed(cache map[byte]cacheEntry) {
+	if !autoSpeedEnabled() || !config.EnableWrite || boostActive {
+		return
+	}
+
+	co2, co2Ok := freshValue(cache, topicCo2Highest)
+	rh, rhOk := freshValue(cache, topicRhHighest)
+
+	if !autoActive {
+		co2High := config.AutoCo2Limit > 0 && co2Ok && int(co2) >= config.AutoCo2Limit
+		rhHigh := config.AutoRhLimit > 0 && rhOk && int(rh) >= config.AutoRhLimit
+		if !co2High && !rhHigh {
+			return
+		}
+		autoActive = true
+		autoRevertSpeed = currentSpeed
+		if currentSpeed >= config.AutoSpeed {
+			// already fast enough, just remember not to lower the speed later
+			autoRevertSpeed = 0
+			return
+		}
+		logInfo.Printf("co2 %d rh %d over limit, raising speed to %d", co2, rh, config.AutoSpeed)
+		requestSpeed(config.AutoSpeed)
+		return
+	}
+
+	co2Normal := config.AutoCo2Limit == 0 || !co2Ok || int(co2) < config.AutoCo2Limit-autoCo2Hysteresis
+	rhNormal := config.AutoRhLimit == 0 || !rhOk || int(rh) < config.AutoRhLimit-autoRhHysteresis
+	if !co2Normal || !rhNormal {
+		return
+	}
+	autoActive = false
+	if autoRevertSpeed != 0 {
+		logInfo.Printf("co2 %d rh %d back to normal, reverting to speed %d", co2, rh, autoRevertSpeed)
+		requestSpeed(autoRevertSpeed)
+	}
+}
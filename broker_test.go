@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	vallox "github.com/pvainio/vallox-rs485"
+)
+
+// startBroker starts embedded mqtt broker on a free local port, messages published
+// by the bridge are sent to the returned channel
+func startBroker(t *testing.T) (*mochi.Server, string, chan packets.Packet) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	broker := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	broker.AddHook(new(auth.AllowHook), nil)
+	if err := broker.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	received := make(chan packets.Packet, 100)
+	broker.Subscribe(topic("#"), 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+	return broker, addr, received
+}
+
+// waitPublish waits for message to topic and returns its payload, other messages are skipped
+func waitPublish(t *testing.T, received chan packets.Packet, topic string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pk := <-received:
+			if pk.TopicName == topic {
+				return string(pk.Payload)
+			}
+		case <-timeout:
+			t.Fatalf("nothing published to %s", topic)
+		}
+	}
+}
+
+// waitSpeedRequest waits for speed request sent by mqtt command handlers
+func waitSpeedRequest(t *testing.T, want byte) {
+	t.Helper()
+	select {
+	case speed := <-speedUpdateRequest:
+		if speed != want {
+			t.Errorf("requested speed %d, want %d", speed, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("speed %d not requested", want)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	withConfig(t)
+	config.EnableWrite = true
+
+	broker, addr, received := startBroker(t)
+	config.MqttUrl = "tcp://" + addr
+
+	startPublishers()
+	mqtt := connectMqtt()
+	defer mqtt.Disconnect(0)
+
+	// online is published after subscribing to commands
+	if status := waitPublish(t, received, topic(topicStatus)); status != statusOnline {
+		t.Fatalf("status %s, want %s", status, statusOnline)
+	}
+
+	t.Run("speed command", func(t *testing.T) {
+		broker.Publish(topic(config.FanCommandTopic), []byte("5"), false, 0)
+		waitSpeedRequest(t, 5)
+	})
+
+	t.Run("speed command out of range", func(t *testing.T) {
+		broker.Publish(topic(config.FanCommandTopic), []byte("12"), false, 0)
+		waitSpeedRequest(t, 8)
+	})
+
+	t.Run("invalid speed command", func(t *testing.T) {
+		broker.Publish(topic(config.FanCommandTopic), []byte("fast"), false, 0)
+		if body := waitPublish(t, received, topic(topicCommandError)); !strings.Contains(body, "fast") {
+			t.Errorf("command error %s does not tell the invalid value", body)
+		}
+		select {
+		case speed := <-speedUpdateRequest:
+			t.Errorf("requested speed %d for invalid command", speed)
+		default:
+		}
+	})
+
+	cache := make(map[byte]cacheEntry)
+	device := newSimulatedVallox()
+
+	t.Run("fan speed event", func(t *testing.T) {
+		handleValloxEvent(device, vallox.Event{Time: time.Now(), Source: vallox.DeviceMain, Destination: vallox.RemoteClientMulticast,
+			Register: vallox.FanSpeed, RawValue: 0x1f, Value: 5}, cache, mqtt)
+		if value := waitPublish(t, received, topic(topicFanSpeed)); value != "5" {
+			t.Errorf("published %s, want %s", value, "5")
+		}
+	})
+
+	t.Run("temperature event", func(t *testing.T) {
+		handleValloxEvent(device, vallox.Event{Time: time.Now(), Source: vallox.DeviceMain, Destination: vallox.RemoteClientMulticast,
+			Register: vallox.TempIncomingOutside, RawValue: 90, Value: -3}, cache, mqtt)
+		if value := waitPublish(t, received, topic(topicTempIncomingOutside)); value != "-3.0" {
+			t.Errorf("published %s, want %s", value, "-3.0")
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// deviceConfig is one entry of Devices, in format id;serial_device;name
+type deviceConfig struct {
+	id     string
+	device string
+	name   string
+}
+
+func parseDevices(devices []string) ([]deviceConfig, error) {
+	var parsed []deviceConfig
+	for _, d := range devices {
+		fields := strings.Split(d, ";")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid device %q, expected id;serial_device;name", d)
+		}
+		dev := deviceConfig{id: fields[0], device: fields[1], name: fields[0]}
+		if len(fields) == 3 {
+			dev.name = fields[2]
+		}
+		parsed = append(parsed, dev)
+	}
+	return parsed, nil
+}
+
+// delay before restarting exited device process, so that failing device does not spin
+const deviceRestartDelay = 5 * time.Second
+
+// runDevices runs own process for each configured device and restarts them if they exit.
+// Processes share the configuration, only device specific values are overridden, so all
+// the topics and discovery are namespaced by device id.
+func runDevices() {
+	devices, err := parseDevices(config.Devices)
+	if err != nil {
+		logError.Fatal(err)
+	}
+
+	if config.MetricsAddr != "" || config.HealthAddr != "" {
+		logInfo.Printf("metrics and health endpoints are not supported with multiple devices")
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	exited := make(chan deviceConfig, len(devices))
+	restart := make(chan deviceConfig, len(devices))
+	running := make(map[string]*exec.Cmd)
+	for _, dev := range devices {
+		running[dev.id] = startDevice(dev, exited)
+	}
+
+	for {
+		select {
+		case sig := <-stop:
+			logInfo.Printf("received %v, stopping devices", sig)
+			for _, cmd := range running {
+				cmd.Process.Signal(sig)
+			}
+			for range running {
+				<-exited
+			}
+			return
+		case dev := <-exited:
+			delete(running, dev.id)
+			logError.Printf("device %s exited, restarting in %v", dev.id, deviceRestartDelay)
+			time.AfterFunc(deviceRestartDelay, func() { restart <- dev })
+		case dev := <-restart:
+			running[dev.id] = startDevice(dev, exited)
+		}
+	}
+}
+
+func startDevice(dev deviceConfig, exited chan deviceConfig) *exec.Cmd {
+	// os.Args[0] may be relative or a symlink, executable is the actual binary
+	exe, err := os.Executable()
+	if err != nil {
+		logError.Fatalf("cannot find executable for device %s: %v", dev.id, err)
+	}
+	cmd := exec.Command(exe)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		deviceEnv("devices", ""),
+		deviceEnv("device_id", dev.id),
+		deviceEnv("device_name", dev.name),
+		deviceEnv("serial_device", dev.device),
+		// client id defaults to device id, shared one would make the processes disconnect each other
+		deviceEnv("mqtt_client_id", ""),
+		deviceEnv("metrics_addr", ""),
+		deviceEnv("health_addr", ""),
+	)
+	if config.StatePath != "" {
+		cmd.Env = append(cmd.Env, deviceEnv("state_path", config.StatePath+"."+dev.id))
+	}
+	if config.TopicPrefix != config.DeviceId {
+		// custom prefix is shared, separate devices under it
+		cmd.Env = append(cmd.Env, deviceEnv("topic_prefix", config.TopicPrefix+"/"+dev.id))
+	} else {
+		cmd.Env = append(cmd.Env, deviceEnv("topic_prefix", ""))
+	}
+
+	logInfo.Printf("starting device %s name %s port %s", dev.id, dev.name, dev.device)
+	if err := cmd.Start(); err != nil {
+		logError.Fatalf("cannot start process for device %s: %v", dev.id, err)
+	}
+
+	go func() {
+		cmd.Wait()
+		exited <- dev
+	}()
+	return cmd
+}
+
+// deviceEnv returns environment variable overriding config value, prefixed variable
+// is used since it has precedence over unprefixed one
+func deviceEnv(key string, value string) string {
+	return "VALLOX_" + strings.ToUpper(key) + "=" + value
+}
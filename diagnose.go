@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	vallox "github.com/pvainio/vallox-rs485"
+)
+
+// time to wait for responses after all queries have been sent
+const diagnoseWait = 5 * time.Second
+
+var diagnoseRequest = make(chan bool, 1)
+
+type diagnoseRegister struct {
+	Register  string `json:"register"`
+	Raw       byte   `json:"raw"`
+	Value     int16  `json:"value"`
+	Formatted string `json:"formatted,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Received  string `json:"received"`
+}
+
+func diagnoseMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	logInfo.Printf("received diagnose request to %s", msg.Topic())
+	diagnoseRequest <- true
+}
+
+// startDiagnose queries all known registers and returns timer for publishing the results
+func startDiagnose() <-chan time.Time {
+	logInfo.Printf("diagnose: querying all registers")
+	queryAllValues()
+	return time.After(time.Duration(len(queryQueue))*config.QueryDelay + diagnoseWait)
+}
+
+// publishDiagnose logs and publishes all values received from the unit with detected protocol
+func publishDiagnose(mqtt mqttClient.Client, cache map[byte]cacheEntry) {
+	protocol := "not detected"
+	if _, isNew := topicMap[vallox.TempIncomingInsideNew]; protocolDetected && isNew {
+		protocol = "new"
+	} else if protocolDetected {
+		protocol = "old"
+	}
+	logInfo.Printf("diagnose: version %s protocol %s", version, protocol)
+
+	registers := make([]diagnoseRegister, 0, len(cache))
+	for register, cached := range cache {
+		r := diagnoseRegister{
+			Register: fmt.Sprintf("0x%02x", register),
+			Raw:      cached.value.RawValue,
+			Value:    cached.value.Value,
+			Received: cached.time.Format(time.RFC3339),
+		}
+		if t, ok := topicMap[register]; ok {
+			r.Topic = t
+			r.Formatted = formatValue(cached.value)
+		}
+		registers = append(registers, r)
+	}
+	sort.Slice(registers, func(i, j int) bool { return registers[i].Register < registers[j].Register })
+	for _, r := range registers {
+		logInfo.Printf("diagnose: register %s raw %d value %d formatted %s topic %s", r.Register, r.Raw, r.Value, r.Formatted, r.Topic)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"version":   version,
+		"protocol":  protocol,
+		"registers": registers,
+	})
+	if err != nil {
+		logError.Printf("cannot marshal json %v", err)
+		return
+	}
+	publish(mqtt, topic(topicDiagnostics), body)
+}
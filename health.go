@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+)
+
+// maximum time without events from Vallox before reporting unhealthy
+const healthEventTimeout = 5 * time.Minute
+
+var (
+	mqttConnected atomic.Bool
+	lastEventTime atomic.Int64
+)
+
+// startHealth starts http server for health checks if health address is configured
+func startHealth() {
+	if config.HealthAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler)
+
+	logInfo.Printf("serving health check at %s/healthz", config.HealthAddr)
+	go func() {
+		err := http.ListenAndServe(config.HealthAddr, mux)
+		logError.Printf("health server stopped: %v", err)
+	}()
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if !mqttConnected.Load() {
+		http.Error(w, "mqtt not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	last := time.Unix(0, lastEventTime.Load())
+	if time.Since(last) > healthEventTimeout {
+		http.Error(w, fmt.Sprintf("no events from vallox since %s", last.Format(time.RFC3339)), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// linkUp tells whether events have been received from Vallox recently, unlike
+// availability which only tells that the bridge itself is running
+var linkUp bool
+
+// updateLink publishes link state when it changes
+func updateLink(mqtt mqttClient.Client, up bool) {
+	if up == linkUp {
+		return
+	}
+	linkUp = up
+	if !up {
+		logError.Printf("no events from vallox in %v, link down", linkTimeout())
+	}
+	publishLink(mqtt, up)
+}
+
+// publishLink publishes link state retained like availability, since it is used for
+// availability of entities and must be known by Home Assistant when it subscribes
+func publishLink(mqtt mqttClient.Client, up bool) {
+	publishWith(mqtt, topic(topicLink), 1, true, formatFlag(up))
+}
+
+// checkLink marks link down if no events have been received within timeout
+func checkLink(mqtt mqttClient.Client) {
+	if time.Since(time.Unix(0, lastEventTime.Load())) > linkTimeout() {
+		updateLink(mqtt, false)
+	}
+}
+
+// linkTimeout returns time without events after which link is down, with heartbeat
+// queries the unit should respond within a few heartbeat intervals
+func linkTimeout() time.Duration {
+	if config.HeartbeatInterval > 0 && 3*config.HeartbeatInterval < healthEventTimeout {
+		return 3 * config.HeartbeatInterval
+	}
+	return healthEventTimeout
+}
+
+// watchdogExpired returns true if no events have been received within watchdog timeout,
+// counting from start if there has not been any events yet
+func watchdogExpired(started time.Time) bool {
+	if config.WatchdogTimeout == 0 {
+		return false
+	}
+	last := started
+	if t := lastEventTime.Load(); t != 0 {
+		last = time.Unix(0, t)
+	}
+	return time.Since(last) > config.WatchdogTimeout
+}
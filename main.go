@@ -1,22 +1,48 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"math/bits"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	vallox "github.com/pvainio/vallox-rs485"
+	"github.com/tarm/serial"
 
 	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
 
 	mqttClient "github.com/eclipse/paho.mqtt.golang"
 )
 
+// valloxClient is the part of vallox-rs485 api used, implemented also by the simulator
+type valloxClient interface {
+	Events() chan vallox.Event
+	ForMe(e vallox.Event) bool
+	Query(register byte)
+	SetSpeed(speed byte)
+}
+
 type cacheEntry struct {
 	time  time.Time
 	value vallox.Event
@@ -24,7 +50,12 @@ type cacheEntry struct {
 
 const (
 	topicFanSpeed            = "fan/speed"
-	topicFanSpeedSet         = "fan/set"
+	topicFanPercentage       = "fan/percentage"
+	topicFanPercentageSet    = "fan/percentage/set"
+	topicFanState            = "fan/state"
+	topicFanStateSet         = "fan/state/set"
+	topicFanSupply           = "fan/supply"
+	topicFanExhaust          = "fan/exhaust"
 	topicTempIncomingIside   = "temp/incoming/inside"
 	topicTempIncomingOutside = "temp/incoming/outside"
 	topicTempOutgoingInside  = "temp/outgoing/inside"
@@ -33,20 +64,116 @@ const (
 	topicRh1                 = "rh/sensor1"
 	topicRh2                 = "rh/sensor2"
 	topicCo2Highest          = "co2/highest"
+	topicCo2Sensors          = "co2/sensors"
+	topicEfficiencyExhaust   = "efficiency/exhaust"
+	topicEfficiency          = "temp/efficiency"
 	topicRaw                 = "raw/%x"
+	topicSerialNumber        = "serial"
+	topicRefresh             = "refresh"
+	topicBoostStart          = "boost/start"
+	topicBoost               = "boost"
+	topicBoostSet            = "boost/set"
+	topicCommandError        = "error"
+	topicStatus              = "status"
+	topicServiceReminder     = "service/reminder"
+	topicServiceRemaining    = "service/remaining"
+	topicFault               = "fault"
+	topicPostHeating         = "heating/post"
+	topicBypass              = "bypass"
+	topicRhSetpoint          = "rh/setpoint"
+	topicLink                = "link"
+	topicDiagnose            = "diagnose"
+	topicDiagnostics         = "diagnostics"
+	topicFanSpeedPercent     = "fan/speed_percent"
+	topicHeating             = "heating"
+	topicVersion             = "version"
+	topicBypassTemperature   = "bypass/temperature"
+	topicHeatingSetpoint     = "heating/setpoint"
+	topicProfile             = "profile"
+	topicProfileSet          = "profile/set"
+	topicMqttConnected       = "mqtt_connected"
+	topicDefrost             = "defrost"
+	topicCounterEvents       = "counter/events"
+	topicCounterPublished    = "counter/published"
+	topicPublishErrors       = "counter/publish_errors"
+	topicSerialErrors        = "counter/serial_errors"
+	topicMqttReconnects      = "counter/mqtt_reconnects"
+	topicState               = "state"
+)
+
+// Registers not (yet) defined in vallox-rs485
+const (
+	// Bit field of installed co2 sensors, bits 1-5 for sensors 1-5
+	co2SensorsInstalled byte = 0x2d
+	// Bit field of indicators, bit 7 service reminder
+	selectFlags byte = 0xa3
+	// Bit field of multi purpose io port, bit 5 post heating on
+	ioPort1 byte = 0x07
+	// Bit field of multi purpose io port, bit 1 bypass damper position (0 winter, 1 summer)
+	ioPort2 byte = 0x08
+	// Code of the latest fault, 0 if none
+	faultCode byte = 0x36
+	// Months remaining until the next service reminder
+	serviceMonthsRemaining byte = 0xab
+	// Supply (input) and exhaust (output) DC fan adjustment percentages, used for balancing the fans
+	fanSupplyPercentage  byte = 0xb0
+	fanExhaustPercentage byte = 0xb1
+	// Bit field of flags, bit 7 heat exchanger freezing, unit is defrosting the cell
+	flags2 byte = 0x6d
+	// Basic humidity level, the humidity limit for boosting speed, same encoding as humidity sensors
+	humidityBasicLevel byte = 0xae
+	// Supply air temperature setpoint for post heating, NTC encoded like temperatures
+	heatingSetpoint byte = 0xa4
+	// Outdoor temperature limit for summer bypass, NTC encoded like temperatures
+	bypassTemperature byte = 0xaf
 )
 
+var faultDescriptions = map[byte]string{
+	0x00: "no fault",
+	0x05: "supply air sensor fault",
+	0x06: "carbon dioxide alarm",
+	0x07: "outdoor air sensor fault",
+	0x08: "extract air sensor fault",
+	0x09: "water radiator danger of freezing",
+	0x0a: "exhaust air sensor fault",
+}
+
+// Topics for single bits of bit field registers, published as ON/OFF
+var flagMap = map[byte]map[byte]string{
+	selectFlags: {
+		0x80: topicServiceReminder,
+	},
+	ioPort1: {
+		0x20: topicPostHeating,
+	},
+	ioPort2: {
+		0x02: topicBypass,
+	},
+	flags2: {
+		0x80: topicDefrost,
+	},
+}
+
 var topicMapOld = map[byte]string{
 	vallox.FanSpeed:            topicFanSpeed,
 	vallox.TempIncomingInside:  topicTempIncomingIside,
 	vallox.TempIncomingOutside: topicTempIncomingOutside,
 	vallox.TempOutgoingInside:  topicTempOutgoingInside,
 	vallox.TempOutgoingOutside: topicTempOutgoingOutside,
-	// vallox.RhHighest:           topicRhHighest,
-	// vallox.Rh1:                 topicRh1,
-	// vallox.Rh2:                 topicRh2,
-	// vallox.Co2HighestHighByte:  topicCo2Highest,
-	// vallox.Co2HighestLowByte:   topicCo2Highest,
+	vallox.RhHighest:           topicRhHighest,
+	vallox.Rh1:                 topicRh1,
+	vallox.Rh2:                 topicRh2,
+	// vallox-rs485 combines co2 bytes, events for both registers contain the ppm value
+	vallox.Co2HighestHighByte: topicCo2Highest,
+	vallox.Co2HighestLowByte:  topicCo2Highest,
+	co2SensorsInstalled:       topicCo2Sensors,
+	faultCode:                 topicFault,
+	fanSupplyPercentage:       topicFanSupply,
+	fanExhaustPercentage:      topicFanExhaust,
+	serviceMonthsRemaining:    topicServiceRemaining,
+	humidityBasicLevel:        topicRhSetpoint,
+	heatingSetpoint:           topicHeatingSetpoint,
+	bypassTemperature:         topicBypassTemperature,
 }
 
 // newer protocol?
@@ -56,33 +183,157 @@ var topicMapNew = map[byte]string{
 	vallox.TempIncomingOutsideNew: topicTempIncomingOutside,
 	vallox.TempOutgoingInsideNew:  topicTempOutgoingInside,
 	vallox.TempOutgoingOutsideNew: topicTempOutgoingOutside,
-	// vallox.RhHighest:              topicRhHighest,
-	// vallox.Rh1:                    topicRh1,
-	// vallox.Rh2:                    topicRh2,
-	// vallox.Co2HighestHighByte:     topicCo2Highest,
-	// vallox.Co2HighestLowByte:      topicCo2Highest,
+	vallox.RhHighest:              topicRhHighest,
+	vallox.Rh1:                    topicRh1,
+	vallox.Rh2:                    topicRh2,
+	vallox.Co2HighestHighByte:     topicCo2Highest,
+	vallox.Co2HighestLowByte:      topicCo2Highest,
+	co2SensorsInstalled:           topicCo2Sensors,
+	faultCode:                     topicFault,
+	fanSupplyPercentage:           topicFanSupply,
+	fanExhaustPercentage:          topicFanExhaust,
+	serviceMonthsRemaining:        topicServiceRemaining,
+	humidityBasicLevel:            topicRhSetpoint,
+	heatingSetpoint:               topicHeatingSetpoint,
+	bypassTemperature:             topicBypassTemperature,
+}
+
+// Protocols selectable with NEW_PROTOCOL, true and false are kept for backward compatibility
+var protocols = map[string]map[byte]string{
+	"old":   topicMapOld,
+	"new":   topicMapNew,
+	"false": topicMapOld,
+	"true":  topicMapNew,
 }
 
 var topicMap map[byte]string
 
+// protocolDetected is true once topicMap is known to match the device
+var protocolDetected bool
+
+// units escaped so that they can not get mangled by editors using wrong encoding
+const (
+	unitCelsius    = "\u00b0C"
+	unitFahrenheit = "\u00b0F"
+)
+
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// Entities whose values are only updated by polling, others are broadcast by Vallox
+var pollDriven = map[string]bool{
+	"fan_speed":         true,
+	"fan_speed_percent": true,
+}
+
+// Entities describing the bridge itself, available whenever the bridge is running
+var bridgeEntities = map[string]bool{
+	"link":                    true,
+	"mqtt_connected":          true,
+	"refresh":                 true,
+	"serial_number":           true,
+	"version":                 true,
+	"counter_events":          true,
+	"counter_published":       true,
+	"counter_publish_errors":  true,
+	"counter_serial_errors":   true,
+	"counter_mqtt_reconnects": true,
+}
+
 var announced map[string]any
 
+// announced is used both by discovery goroutine and by main loop for raw values
+var announcedLock sync.Mutex
+
 type Config struct {
-	SerialDevice string `envconfig:"serial_device" required:"true"`
-	MqttUrl      string `envconfig:"mqtt_url" required:"true"`
-	MqttUser     string `envconfig:"mqtt_user"`
-	MqttPwd      string `envconfig:"mqtt_password"`
-	MqttClientId string `envconfig:"mqtt_client_id"`
-	DeviceId     string `envconfig:"device_id" default:"vallox"`
-	DeviceName   string `envconfig:"device_name" default:"Vallox"`
-	Debug        bool   `envconfig:"debug" default:"false"`
-	EnableWrite  bool   `envconfig:"enable_write" default:"false"`
-	SpeedMin     byte   `envconfig:"speed_min" default:"1"`
-	EnableRaw    bool   `envconfig:"enable_raw" default:"false"`
-	ObjectId     bool   `envconfig:"object_id" default:"true"`
-	NewProtocol  bool   `envconfig:"new_protocol" default:"false"`
+	SerialDevice             string            `envconfig:"serial_device"`
+	MqttUrl                  string            `envconfig:"mqtt_url" required:"true"`
+	MqttUser                 string            `envconfig:"mqtt_user"`
+	MqttPwd                  string            `envconfig:"mqtt_password"`
+	MqttClientId             string            `envconfig:"mqtt_client_id"`
+	MqttCaCert               string            `envconfig:"mqtt_ca_cert"`
+	MqttClientCert           string            `envconfig:"mqtt_client_cert"`
+	MqttClientKey            string            `envconfig:"mqtt_client_key"`
+	MqttTlsInsecure          bool              `envconfig:"mqtt_tls_insecure" default:"false"`
+	MqttKeepAlive            time.Duration     `envconfig:"mqtt_keep_alive" default:"150s"`
+	MqttConnectTimeout       time.Duration     `envconfig:"mqtt_connect_timeout" default:"30s"`
+	MqttAutoReconnect        bool              `envconfig:"mqtt_auto_reconnect" default:"true"`
+	MqttMaxReconnectInterval time.Duration     `envconfig:"mqtt_max_reconnect_interval" default:"10m"`
+	DeviceId                 string            `envconfig:"device_id" default:"vallox"`
+	DeviceName               string            `envconfig:"device_name" default:"Vallox"`
+	DeviceSerial             string            `envconfig:"device_serial"`
+	DeviceModel              string            `envconfig:"device_model" default:"Digit SE"`
+	ConfigurationUrl         string            `envconfig:"configuration_url"`
+	Debug                    bool              `envconfig:"debug" default:"false"`
+	EnableWrite              bool              `envconfig:"enable_write" default:"false"`
+	SpeedMin                 byte              `envconfig:"speed_min" default:"1"`
+	EnableRaw                bool              `envconfig:"enable_raw" default:"false"`
+	ObjectId                 bool              `envconfig:"object_id" default:"true"`
+	NewProtocol              string            `envconfig:"new_protocol" default:"auto"`
+	FanEntity                bool              `envconfig:"fan_entity" default:"false"`
+	FanNumber                bool              `envconfig:"fan_number" default:"false"`
+	RetainDiscovery          bool              `envconfig:"retain_discovery" default:"false"`
+	RetainState              bool              `envconfig:"retain_state" default:"false"`
+	StateJson                bool              `envconfig:"state_json" default:"false"`
+	MetricsAddr              string            `envconfig:"metrics_addr"`
+	HealthAddr               string            `envconfig:"health_addr"`
+	BoostDuration            time.Duration     `envconfig:"boost_duration" default:"15m"`
+	SpeedDebounce            time.Duration     `envconfig:"speed_debounce" default:"300ms"`
+	PollInterval             time.Duration     `envconfig:"poll_interval" default:"15m"`
+	StatePath                string            `envconfig:"state_path"`
+	LogFormat                string            `envconfig:"log_format" default:"text"`
+	Simulate                 bool              `envconfig:"simulate" default:"false"`
+	Devices                  []string          `envconfig:"devices"`
+	HaStatusTopic            string            `envconfig:"ha_status_topic" default:"homeassistant/status"`
+	HaOnlinePayload          string            `envconfig:"ha_online_payload" default:"online"`
+	SerialLock               bool              `envconfig:"serial_lock" default:"false"`
+	LockDir                  string            `envconfig:"lock_dir" default:"/var/lock"`
+	SerialFlush              bool              `envconfig:"serial_flush" default:"false"`
+	QueryDelay               time.Duration     `envconfig:"query_delay" default:"100ms"`
+	AutoCo2Limit             int               `envconfig:"auto_co2_limit" default:"0"`
+	AutoRhLimit              int               `envconfig:"auto_rh_limit" default:"0"`
+	AutoSpeed                byte              `envconfig:"auto_speed" default:"6"`
+	ExpireAfter              time.Duration     `envconfig:"expire_after"`
+	TopicPrefix              string            `envconfig:"topic_prefix"`
+	LogLevel                 string            `envconfig:"log_level" default:"info"`
+	RawJson                  bool              `envconfig:"raw_json" default:"false"`
+	SpeedRetries             int               `envconfig:"speed_retries" default:"2"`
+	AvailabilityLink         bool              `envconfig:"availability_link" default:"true"`
+	MinPublishInterval       time.Duration     `envconfig:"min_publish_interval" default:"0s"`
+	DisabledEntities         []string          `envconfig:"disabled_entities"`
+	ProfileHomeSpeed         byte              `envconfig:"profile_home_speed" default:"3"`
+	ProfileAwaySpeed         byte              `envconfig:"profile_away_speed" default:"1"`
+	ObjectIdTemplate         string            `envconfig:"object_id_template" default:"{device_id}_{uid}"`
+	MqttVersion              string            `envconfig:"mqtt_version"`
+	SpeedPercentages         []int             `envconfig:"speed_percentages"`
+	RetainAvailability       bool              `envconfig:"retain_availability" default:"true"`
+	FanCommandTopic          string            `envconfig:"fan_command_topic" default:"fan/set"`
+	MqttClientIdSuffix       bool              `envconfig:"mqtt_client_id_suffix" default:"false"`
+	DeviceManufacturer       string            `envconfig:"device_manufacturer" default:"Vallox"`
+	EntityNames              map[string]string `envconfig:"entity_names"`
+	WatchdogTimeout          time.Duration     `envconfig:"watchdog_timeout" default:"0s"`
+	DiscoveryQos             byte              `envconfig:"discovery_qos" default:"0"`
+	HeartbeatInterval        time.Duration     `envconfig:"heartbeat_interval" default:"0s"`
+	MirrorMqttUrl            string            `envconfig:"mirror_mqtt_url"`
+	MirrorMqttUser           string            `envconfig:"mirror_mqtt_user"`
+	MirrorMqttPwd            string            `envconfig:"mirror_mqtt_password"`
+	PromiscuousRead          bool              `envconfig:"promiscuous_read" default:"false"`
+	Diagnose                 bool              `envconfig:"diagnose" default:"false"`
+	TemperatureUnit          string            `envconfig:"temperature_unit" default:"C"`
+	HaOfflinePayload         string            `envconfig:"ha_offline_payload" default:"offline"`
 }
 
+// delay for announcing after HA online message, HA restart can send several of them
+const announceDebounce = 2 * time.Second
+
+// time to wait for the unit to report the speed that was sent, before sending it again
+const speedConfirmTimeout = 5 * time.Second
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
 var (
 	config Config
 
@@ -90,85 +341,400 @@ var (
 	logInfo  *log.Logger
 	logError *log.Logger
 
-	updateSpeed          byte
-	updateSpeedRequested time.Time
-	currentSpeed         byte
-	currentSpeedUpdated  time.Time
+	updateSpeed         byte
+	updateSpeedPending  bool
+	currentSpeed        byte
+	currentSpeedUpdated time.Time
+
+	// fires when requested speed should be sent, nil when there is nothing to send
+	speedTimer <-chan time.Time
+
+	speedConfirmPending bool
+	speedRetriesLeft    int
 
 	speedUpdateRequest = make(chan byte, 10)
-	speedUpdateSend    = make(chan byte, 10)
 
 	homeassistantStatus = make(chan string, 10)
+
+	refreshRequest = make(chan bool, 10)
+
+	profileRequest = make(chan string, 10)
+
+	boostRequest     = make(chan bool, 10)
+	boostActive      bool
+	boostRevertSpeed byte
+
+	queryQueue  []byte
+	lastQueried = make(map[byte]time.Time)
+
+	stateJsonRequest = make(chan bool, 1)
+	stateJsonPending bool
+
+	lastPublished  = make(map[byte]time.Time)
+	publishPending = make(map[byte]bool)
+	publishRequest = make(chan byte, 10)
 )
 
-func init() {
+// loadConfig reads configuration from config file and environment and sets up logging
+func loadConfig() {
+	if file := os.Getenv("VALLOX_CONFIG"); file != "" {
+		if err := loadConfigFile(file); err != nil {
+			log.Fatalf("cannot load config file %s: %v", file, err)
+		}
+	}
 
 	err := envconfig.Process("vallox", &config)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	if config.NewProtocol {
-		topicMap = topicMapNew
-	} else {
+	if config.SerialDevice == "" && !config.Simulate && len(config.Devices) == 0 {
+		log.Fatal("required key SERIAL_DEVICE missing value")
+	}
+
+	if config.NewProtocol == "auto" {
+		// detected from the first temperature event received
 		topicMap = topicMapOld
+	} else if m, ok := protocols[config.NewProtocol]; ok {
+		topicMap = m
+		protocolDetected = true
+	} else {
+		log.Fatalf("unknown protocol %s", config.NewProtocol)
+	}
+
+	if config.TemperatureUnit != "C" && config.TemperatureUnit != "F" {
+		log.Fatalf("unknown temperature unit %s, use C or F", config.TemperatureUnit)
+	}
+
+	if config.PollInterval <= 0 {
+		log.Fatalf("POLL_INTERVAL must be positive, got %v", config.PollInterval)
+	}
+
+	if len(config.SpeedPercentages) != 0 && len(config.SpeedPercentages) != 8 {
+		log.Fatalf("SPEED_PERCENTAGES must have 8 values, one for each speed, got %d", len(config.SpeedPercentages))
 	}
 
 	if config.MqttClientId == "" {
 		config.MqttClientId = config.DeviceId
 	}
 
+	if config.MqttClientIdSuffix {
+		// random suffix so that instances with the same device id don't disconnect each other
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			log.Fatalf("cannot generate client id suffix: %v", err)
+		}
+		config.MqttClientId += "-" + hex.EncodeToString(suffix)
+	}
+
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = config.DeviceId
+	}
+
 	initLogging()
 
-	logInfo.Printf("starting with device id %s name %s port %s", config.DeviceId, config.DeviceName, config.SerialDevice)
+	logInfo.Printf("starting version %s with device id %s name %s port %s", version, config.DeviceId, config.DeviceName, config.SerialDevice)
+
+	if autoSpeedEnabled() && !config.EnableWrite {
+		logError.Printf("automatic speed limits configured but ENABLE_WRITE is not set, speed is not changed")
+	}
+}
+
+// loadConfigFile reads yaml or json config file with the same keys as environment
+// variables, like serial_device.  Values are set to environment unless already set
+// there, so environment overrides the file and envconfig handles parsing and defaults.
+func loadConfigFile(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	// yaml is superset of json, so this handles both
+	values := make(map[string]any)
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		name := strings.ToUpper(key)
+		if _, ok := os.LookupEnv("VALLOX_" + name); ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		os.Setenv(name, configValue(value))
+	}
+	return nil
+}
+
+// configValue formats config file value in the format envconfig expects
+func configValue(value any) string {
+	switch v := value.(type) {
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	case map[string]any:
+		items := make([]string, 0, len(v))
+		for key, item := range v {
+			items = append(items, fmt.Sprintf("%s:%v", key, item))
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
 }
 
 func main() {
+	showVersion := flag.Bool("version", false, "print version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
+	loadConfig()
 
+	if len(config.Devices) > 0 {
+		runDevices()
+		return
+	}
+
+	startMetrics()
+	startHealth()
+
+	startPublishers()
+	connectMirror()
 	mqtt := connectMqtt()
 
 	valloxDevice := connectVallox()
 
-	cache := make(map[byte]cacheEntry)
+	cache := loadCache()
+	if cached, ok := cache[vallox.FanSpeed]; ok {
+		currentSpeed = byte(cached.value.Value)
+	}
 
 	announceMeToMqttDiscovery(mqtt, cache)
+	// publish persisted values right away instead of waiting for the device
+	republishValues(mqtt, cache)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	started := time.Now()
+
+	// fires when fan speed should be queried to check that the unit responds, nil if disabled
+	var heartbeat <-chan time.Time
+	if config.HeartbeatInterval > 0 {
+		heartbeat = time.NewTicker(config.HeartbeatInterval).C
+	}
+	deviceCheck := time.NewTicker(10 * time.Second)
+	poll := time.NewTicker(config.PollInterval)
+	counters := time.NewTicker(time.Minute)
+	stateSave := time.NewTicker(stateSaveInterval)
+
+	// fires when sent speed should have been confirmed by the unit, nil when not waiting for confirmation
+	var confirmTimer <-chan time.Time
+
+	// fires when discovery should be sent after HA became online, nil when not needed
+	var announceTimer <-chan time.Time
+
+	// fires when diagnose results should be published, nil when diagnose is not running
+	var diagnoseTimer <-chan time.Time
+	if config.Diagnose {
+		diagnoseRequest <- true
+	}
+
+	// fires when boost should be turned off, nil when there is no timed boost
+	var boostTimer <-chan time.Time
+
+	// fires when next queued register query should be sent, nil when queue is empty
+	var queryTimer <-chan time.Time
+
+	// fires when serial device should be opened again, nil when not reconnecting
+	var reconnectTimer <-chan time.Time
+	reconnectDelay := time.Second
 
 	for {
+		if queryTimer == nil && len(queryQueue) > 0 {
+			queryTimer = time.After(config.QueryDelay)
+		}
 		select {
+		case sig := <-stop:
+			logInfo.Printf("received %v, shutting down", sig)
+			saveChangedCache(cache)
+			shutdown(mqtt)
+			return
 		case event := <-valloxDevice.Events():
 			handleValloxEvent(valloxDevice, event, cache, mqtt)
 		case request := <-speedUpdateRequest:
-			if hasSameRecentSpeed(request) {
-				continue
+			requestSpeed(request)
+		case <-speedTimer:
+			speedTimer = nil
+			if sendSpeed(valloxDevice) {
+				confirmTimer = time.After(speedConfirmTimeout)
+			}
+		case <-confirmTimer:
+			confirmTimer = nil
+			if retrySpeed(valloxDevice) {
+				confirmTimer = time.After(speedConfirmTimeout)
 			}
-			updateSpeed = request
-			updateSpeedRequested = time.Now()
-			speedUpdateSend <- request
-		case <-speedUpdateSend:
-			sendSpeed(valloxDevice)
 		case status := <-homeassistantStatus:
-			if status == "online" {
-				// HA became online, send discovery so it knows about entities
-				go announceMeToMqttDiscovery(mqtt, cache)
-			} else if status != "offline" {
-				logInfo.Printf("unknown HA status message %s", status)
+			if status == config.HaOnlinePayload {
+				// HA became online, restart debounce so that a burst of online messages
+				// announces only once
+				announceTimer = time.After(announceDebounce)
+			} else if status == config.HaOfflinePayload {
+				logDebug.Printf("HA went offline")
+			} else {
+				logDebug.Printf("ignoring unknown HA status message %s", status)
+			}
+		case <-announceTimer:
+			announceTimer = nil
+			// send discovery so that HA knows about entities
+			announceMeToMqttDiscovery(mqtt, cache)
+			// and current values so entities don't stay unknown until next change
+			republishValues(mqtt, cache)
+			publishLink(mqtt, linkUp)
+			// computed heating state is published again with the next temperature
+			heatingState = ""
+		case on := <-boostRequest:
+			if on {
+				boostTimer = startBoost(mqtt)
+			} else {
+				boostTimer = nil
+				stopBoost(mqtt)
+			}
+		case profile := <-profileRequest:
+			if profile == profileBoost {
+				boostTimer = startBoost(mqtt)
+				continue
+			}
+			if boostActive {
+				// profile replaces boost, no need to revert
+				boostTimer = nil
+				boostActive = false
+				publishState(mqtt, topic(topicBoost), "OFF")
 			}
-		case <-time.Tick(15 * time.Minute):
-			queryValues(valloxDevice, cache)
+			requestSpeed(profileSpeed(profile))
+		case <-boostTimer:
+			logInfo.Printf("boost duration elapsed")
+			boostTimer = nil
+			stopBoost(mqtt)
+		case <-deviceCheck.C:
+			checkLink(mqtt)
+			if !config.Simulate && reconnectTimer == nil && serialDeviceGone() {
+				metricSerialErrors.Inc()
+				countSerialErrors.Add(1)
+				publishAvailability(mqtt, statusOffline)
+				reconnectDelay = time.Second
+				reconnectTimer = time.After(reconnectDelay)
+			}
+			if watchdogExpired(started) {
+				// vallox-rs485 can not close the serial port, so exiting is the only way to
+				// reopen it, service manager or DEVICES parent must start the bridge again
+				logError.Printf("watchdog: no events from vallox in %v, exiting for restart", config.WatchdogTimeout)
+				saveChangedCache(cache)
+				shutdown(mqtt)
+				os.Exit(2)
+			}
+		case <-reconnectTimer:
+			if device := reconnectVallox(mqtt); device != nil {
+				valloxDevice = device
+				reconnectTimer = nil
+			} else {
+				reconnectDelay = min(reconnectDelay*2, time.Minute)
+				reconnectTimer = time.After(reconnectDelay)
+			}
+		case <-diagnoseRequest:
+			diagnoseTimer = startDiagnose()
+		case <-diagnoseTimer:
+			diagnoseTimer = nil
+			publishDiagnose(mqtt, cache)
+		case <-heartbeat:
+			enqueueQuery(vallox.FanSpeed)
+		case <-refreshRequest:
+			queryAllValues()
+		case register := <-publishRequest:
+			delete(publishPending, register)
+			lastPublished[register] = time.Now()
+			publishValue(mqtt, cache[register].value)
+		case <-stateJsonRequest:
+			stateJsonPending = false
+			publishStateJson(mqtt, cache)
+		case <-counters.C:
+			publishCounters(mqtt)
+		case <-stateSave.C:
+			saveChangedCache(cache)
+		case <-poll.C:
+			queryValues(cache)
+		case <-queryTimer:
+			queryTimer = nil
+			sendQuery(valloxDevice)
 		case <-time.After(time.Second):
 			// query initial values
-			queryValues(valloxDevice, cache)
+			queryValues(cache)
+		}
+	}
+}
+
+// shutdown marks bridge offline and disconnects cleanly, giving up after timeout
+// so that stuck write can not prevent exit
+func shutdown(mqtt mqttClient.Client) {
+	done := make(chan bool)
+	go func() {
+		mqtt.Publish(topic(topicMqttConnected), 1, true, formatFlag(false))
+		t := mqtt.Publish(topic(topicStatus), 1, config.RetainAvailability, statusOffline)
+		t.WaitTimeout(2 * time.Second)
+		mqtt.Disconnect(250)
+		// vallox-rs485 does not support closing the device, serial port is closed on exit
+		if config.SerialLock {
+			unlockSerial(config.SerialDevice)
 		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		logInfo.Printf("shutdown complete")
+	case <-time.After(5 * time.Second):
+		logError.Printf("shutdown timed out")
 	}
 }
 
-func handleValloxEvent(valloxDev *vallox.Vallox, e vallox.Event, cache map[byte]cacheEntry, mqtt mqttClient.Client) {
+func handleValloxEvent(valloxDev valloxClient, e vallox.Event, cache map[byte]cacheEntry, mqtt mqttClient.Client) {
+	lastEventTime.Store(e.Time.UnixNano())
+	countEvents.Add(1)
+	updateLink(mqtt, true)
+
 	if !valloxDev.ForMe(e) {
-		return // Ignore values not addressed for me
+		if !config.PromiscuousRead {
+			return // Ignore values not addressed for me
+		}
+		// observe values sent to other devices too, they are only read
+		logDebug.Printf("observed register %x value %d from %x to %x", e.Register, e.RawValue, e.Source, e.Destination)
+	}
+
+	if !validEvent(e) {
+		logDebug.Printf("dropping invalid value %d for register %x", e.Value, e.Register)
+		return
+	}
+
+	if detectProtocol(e) {
+		// topics stay the same but registers changed, so refresh discovery
+		announceMeToMqttDiscovery(mqtt, cache)
 	}
 
 	logDebug.Printf("received register %d value %d matching %s", e.Register, e.Value, topicMap[e.Register])
 
+	if e.Register == vallox.FanSpeed {
+		checkSpeedConflict(e)
+		confirmSpeed(e)
+	}
+
 	if val, ok := cache[e.Register]; !ok {
 		// First time we receive this value, send Home Assistant discovery
 		announceRawData(mqtt, e.Register)
@@ -179,48 +745,406 @@ func handleValloxEvent(valloxDev *vallox.Vallox, e vallox.Event, cache map[byte]
 
 	cached := cacheEntry{time: time.Now(), value: e}
 	cache[e.Register] = cached
+	cacheChanged = true
 
 	if e.Register == vallox.FanSpeed {
 		currentSpeed = byte(e.Value)
 		currentSpeedUpdated = cached.time
 	}
 
-	go publishValue(mqtt, cached.value)
+	if wait := config.MinPublishInterval - time.Since(lastPublished[e.Register]); wait > 0 {
+		// published recently, publish the latest value when interval has elapsed
+		delayPublish(e.Register, wait)
+	} else {
+		lastPublished[e.Register] = cached.time
+		publishValue(mqtt, cached.value)
+	}
+
+	if t, ok := topicMap[e.Register]; ok {
+		updateMetric(t, formatValue(e))
+	}
+
+	if config.StateJson && !stateJsonPending {
+		// throttle combined state to once per second
+		stateJsonPending = true
+		time.AfterFunc(time.Second, func() { stateJsonRequest <- true })
+	}
+
+	if isTemperature(e.Register) {
+		publishEfficiency(mqtt, cache)
+	}
+
+	if isTemperature(e.Register) || e.Register == ioPort1 {
+		publishHeating(mqtt, cache)
+	}
+
+	if t := topicMap[e.Register]; t == topicCo2Highest || t == topicRhHighest {
+		checkAutoSpeed(cache)
+	}
 }
 
-func sendSpeed(valloxDevice *vallox.Vallox) {
-	if time.Since(updateSpeedRequested) < time.Duration(5)*time.Second {
-		// Less than second old, retry later
-		go func() {
-			time.Sleep(time.Duration(1000) * time.Millisecond)
-			speedUpdateSend <- updateSpeed
-		}()
-	} else if currentSpeed != updateSpeed || time.Since(currentSpeedUpdated) > 10*time.Second {
+// validEvent returns false for events with values that can not be real, caused for
+// example by bus glitches, so that they are not published
+func validEvent(e vallox.Event) bool {
+	if e.Register == 0 {
+		return false
+	}
+
+	t := topicMapOld[e.Register]
+	if t == "" {
+		t = topicMapNew[e.Register]
+	}
+	switch {
+	case t == topicFanSpeed:
+		return e.Value >= 1 && e.Value <= 8
+	case strings.HasPrefix(t, "temp/"):
+		return e.Value >= -50 && e.Value <= 90
+	case t == topicRhHighest || t == topicRh1 || t == topicRh2:
+		return e.Value >= 0 && e.Value <= 100
+	case t == topicCo2Highest:
+		return e.Value >= 0 && e.Value <= 10000
+	}
+	return true
+}
+
+// delayPublish requests publishing of cached register value after wait, unless already requested
+func delayPublish(register byte, wait time.Duration) {
+	if publishPending[register] {
+		return
+	}
+	publishPending[register] = true
+	time.AfterFunc(wait, func() { publishRequest <- register })
+}
+
+// detectProtocol selects topic map based on the first broadcast event from register that
+// is used only by one of the protocols, returns true if protocol was detected
+func detectProtocol(e vallox.Event) bool {
+	if protocolDetected {
+		return false
+	}
+	if e.Destination != vallox.RemoteClientMulticast {
+		// reply to a query only tells that the unit answers that address,
+		// not which registers it actually uses
+		return false
+	}
+
+	_, inOld := topicMapOld[e.Register]
+	_, inNew := topicMapNew[e.Register]
+	if inOld == inNew {
+		// common or unknown register, does not tell the protocol
+		return false
+	}
+
+	protocolDetected = true
+	if inNew {
+		logInfo.Printf("detected new protocol from register %x", e.Register)
+		topicMap = topicMapNew
+	} else {
+		logInfo.Printf("detected old protocol from register %x", e.Register)
+		topicMap = topicMapOld
+	}
+	return true
+}
+
+// publishEfficiency calculates heat recovery efficiencies for supply and exhaust side
+// from the four temperatures, if all of them are known and fresh
+func publishEfficiency(mqtt mqttClient.Client, cache map[byte]cacheEntry) {
+	outdoor, ok1 := freshValue(cache, topicTempIncomingOutside)
+	supply, ok2 := freshValue(cache, topicTempIncomingIside)
+	extract, ok3 := freshValue(cache, topicTempOutgoingInside)
+	exhaust, ok4 := freshValue(cache, topicTempOutgoingOutside)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return
+	}
+
+	diff := float64(extract - outdoor)
+	if math.Abs(diff) < efficiencyMinDiff {
+		// with small temperature difference one degree of measurement error
+		// changes the result a lot, so efficiency is meaningless
+		return
+	}
+
+	supplyEff := float64(supply-outdoor) / diff * 100
+	exhaustEff := float64(extract-exhaust) / diff * 100
+
+	if validEfficiency(supplyEff) {
+		// supply side efficiency is the commonly used heat recovery efficiency
+		publishState(mqtt, topic(topicEfficiency), fmt.Sprintf("%.0f", supplyEff))
+	}
+	if validEfficiency(exhaustEff) {
+		publishState(mqtt, topic(topicEfficiencyExhaust), fmt.Sprintf("%.0f", exhaustEff))
+	}
+}
+
+// inside and outdoor temperatures must differ at least this much for efficiency to be calculated
+const efficiencyMinDiff = 5
+
+// validEfficiency returns false for results that are not possible, like when post heater
+// warms supply air or bypass is open
+func validEfficiency(eff float64) bool {
+	return eff >= 0 && eff <= 100
+}
+
+// supply air must be this much warmer than extract air to be considered heated
+const heatingMargin = 2
+
+// last published heating state, empty if not published
+var heatingState string
+
+// publishHeating publishes whether the unit is heating supply air, either with post heater
+// or supply air being warmer than extract air, when the state changes
+func publishHeating(mqtt mqttClient.Client, cache map[byte]cacheEntry) {
+	postHeating := false
+	postHeatingOk := false
+	if cached, ok := cache[ioPort1]; ok && time.Since(cached.time) < config.PollInterval {
+		postHeating = cached.value.RawValue&0x20 != 0
+		postHeatingOk = true
+	}
+	supply, supplyOk := freshValue(cache, topicTempIncomingIside)
+	extract, extractOk := freshValue(cache, topicTempOutgoingInside)
+	if !postHeatingOk && (!supplyOk || !extractOk) {
+		// nothing to tell heating from
+		return
+	}
+
+	heating := postHeating || (supplyOk && extractOk && supply > extract+heatingMargin)
+	state := formatFlag(heating)
+	if state == heatingState {
+		return
+	}
+	heatingState = state
+	publishState(mqtt, topic(topicHeating), state)
+}
+
+// freshValue returns cached value for the topic if it has been updated during the last poll interval
+func freshValue(cache map[byte]cacheEntry, t string) (int16, bool) {
+	for register, regTopic := range topicMap {
+		if regTopic != t {
+			continue
+		}
+		if cached, ok := cache[register]; ok && time.Since(cached.time) < config.PollInterval {
+			return cached.value.Value, true
+		}
+	}
+	return 0, false
+}
+
+// checkSpeedConflict drops pending speed update if someone else, like the control panel,
+// changed the speed meanwhile so that we don't fight over the speed
+func checkSpeedConflict(e vallox.Event) {
+	if updateSpeedPending && e.Source != vallox.DeviceMain && byte(e.Value) != updateSpeed {
+		logInfo.Printf("speed changed to %d by %x while update to %d pending, dropping pending update", e.Value, e.Source, updateSpeed)
+		updateSpeedPending = false
+	}
+}
+
+// republishValues publishes all cached values again. Cache is kept for the whole
+// lifetime of the process so it can be used to restore state after re-initialization.
+func republishValues(mqtt mqttClient.Client, cache map[byte]cacheEntry) {
+	for _, cached := range cache {
+		publishValue(mqtt, cached.value)
+	}
+}
+
+// sendSpeed sends pending speed update, returns true if speed was sent and should be confirmed
+func sendSpeed(valloxDevice valloxClient) bool {
+	if !updateSpeedPending {
+		// already sent or overridden by other device
+		return false
+	}
+	updateSpeedPending = false
+	if currentSpeed != updateSpeed || time.Since(currentSpeedUpdated) > 10*time.Second {
 		logDebug.Printf("sending speed update to %x", updateSpeed)
 		currentSpeed = updateSpeed
 		currentSpeedUpdated = time.Now()
-		valloxDevice.SetSpeed(updateSpeed)
-		time.Sleep(time.Duration(20) * time.Millisecond)
-		valloxDevice.Query(vallox.FanSpeed)
+		writeSpeed(valloxDevice, updateSpeed)
+		speedConfirmPending = true
+		speedRetriesLeft = config.SpeedRetries
+		return true
 	}
+	return false
+}
+
+// writeSpeed writes speed and queries it back for confirmation
+func writeSpeed(valloxDevice valloxClient, speed byte) {
+	valloxDevice.SetSpeed(speed)
+	time.Sleep(time.Duration(20) * time.Millisecond)
+	valloxDevice.Query(vallox.FanSpeed)
+}
+
+// confirmSpeed stops waiting for confirmation when the unit reports the requested speed,
+// or when someone else, like the control panel, has set another speed meanwhile.
+// Only the main unit confirms, the speed we sent may be echoed back from the bus.
+func confirmSpeed(e vallox.Event) {
+	if !speedConfirmPending {
+		return
+	}
+	if e.Source != vallox.DeviceMain {
+		if byte(e.Value) != updateSpeed {
+			speedConfirmPending = false
+		}
+		return
+	}
+	if byte(e.Value) == updateSpeed {
+		logDebug.Printf("speed %d confirmed", e.Value)
+		speedConfirmPending = false
+	}
+}
+
+// retrySpeed writes speed again if it has not been confirmed, returns true if retried
+func retrySpeed(valloxDevice valloxClient) bool {
+	if !speedConfirmPending {
+		return false
+	}
+	if speedRetriesLeft <= 0 {
+		logError.Printf("speed %d not confirmed by the unit, giving up", updateSpeed)
+		speedConfirmPending = false
+		return false
+	}
+	speedRetriesLeft--
+	logInfo.Printf("speed %d not confirmed by the unit, retrying", updateSpeed)
+	writeSpeed(valloxDevice, updateSpeed)
+	return true
+}
+
+// requestSpeed sets speed to be sent after debounce. Called from the main loop, other
+// goroutines use speedUpdateRequest.
+func requestSpeed(request byte) {
+	if hasSameRecentSpeed(request) {
+		return
+	}
+	updateSpeed = request
+	updateSpeedPending = true
+	// restart debounce so that only the last of rapid requests is sent
+	speedTimer = time.After(config.SpeedDebounce)
 }
 
 func hasSameRecentSpeed(request byte) bool {
 	return currentSpeed == request && time.Since(currentSpeedUpdated) < time.Duration(10)*time.Second
 }
 
-func connectVallox() *vallox.Vallox {
+func connectVallox() valloxClient {
+	if config.Simulate {
+		logInfo.Printf("simulating vallox device")
+		return newSimulatedVallox()
+	}
+
+	valloxDevice, err := openVallox()
+
+	if err != nil {
+		logError.Fatalf("error opening Vallox device %s: %v", config.SerialDevice, err)
+	}
+
+	return valloxDevice
+}
+
+func openVallox() (*vallox.Vallox, error) {
 	cfg := vallox.Config{Device: config.SerialDevice, EnableWrite: config.EnableWrite, LogDebug: logDebug}
 
+	if strings.Contains(config.SerialDevice, "://") {
+		// vallox-rs485 opens the serial port itself and can not use a network connection
+		return nil, fmt.Errorf("network device %s not supported, expose the converter as local device, for example with socat", config.SerialDevice)
+	}
+
+	if config.SerialLock {
+		if err := lockSerial(config.SerialDevice); err != nil {
+			return nil, fmt.Errorf("cannot lock serial device: %w", err)
+		}
+	}
+
+	if config.SerialFlush {
+		if err := flushSerial(config.SerialDevice); err != nil {
+			return nil, fmt.Errorf("cannot flush serial device: %w", err)
+		}
+	}
+
 	logInfo.Printf("connecting to vallox serial port %s write enabled: %v", cfg.Device, cfg.EnableWrite)
 
-	valloxDevice, err := vallox.Open(cfg)
+	return vallox.Open(cfg)
+}
 
+// flushSerial discards data left in the serial port buffers, for example by another tool.
+// vallox-rs485 does not expose the port it opens, so the port is opened and closed here first.
+func flushSerial(device string) error {
+	port, err := serial.OpenPort(&serial.Config{Name: device, Baud: 9600, Size: 8, Parity: serial.ParityNone, StopBits: serial.Stop1})
 	if err != nil {
-		logError.Fatalf("error opening Vallox device %s: %v", config.SerialDevice, err)
+		return err
 	}
+	defer port.Close()
+	return port.Flush()
+}
 
-	return valloxDevice
+// serialDeviceGone checks if serial device has disappeared. vallox-rs485 can not close the
+// port, so the device is reopened only when the old port is gone with it.  Prolonged
+// silence on an existing device is handled by the watchdog.
+func serialDeviceGone() bool {
+	if _, err := os.Stat(config.SerialDevice); err != nil {
+		logError.Printf("serial device %s disappeared, reconnecting", config.SerialDevice)
+		return true
+	}
+	return false
+}
+
+// reconnectVallox opens serial device again, returns nil if it failed and should be retried
+func reconnectVallox(mqtt mqttClient.Client) valloxClient {
+	device, err := openVallox()
+	if err != nil {
+		metricSerialErrors.Inc()
+		countSerialErrors.Add(1)
+		logError.Printf("reconnecting to %s failed: %v", config.SerialDevice, err)
+		return nil
+	}
+	logInfo.Printf("serial device %s reconnected", config.SerialDevice)
+	publishAvailability(mqtt, statusOnline)
+	// cache is kept, just refresh the values
+	queryAllValues()
+	return device
+}
+
+func lockFile(device string) string {
+	return filepath.Join(config.LockDir, "LCK.."+filepath.Base(device))
+}
+
+// lockSerial creates UUCP style lock file for the serial device so that other
+// tools honoring the same convention do not open the port at the same time
+func lockSerial(device string) error {
+	file := lockFile(device)
+
+	if content, err := os.ReadFile(file); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err == nil && pid == os.Getpid() {
+			// our own lock, for example when reconnecting
+			return nil
+		}
+		if err == nil && processExists(pid) {
+			return fmt.Errorf("device busy, locked by pid %d in %s", pid, file)
+		}
+		// stale lock, owner process is gone
+		logInfo.Printf("removing stale lock file %s", file)
+		os.Remove(file)
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%10d\n", os.Getpid())
+	return err
+}
+
+// processExists returns true if process is running, also when it belongs to another user
+// and can not be signaled
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func unlockSerial(device string) {
+	if err := os.Remove(lockFile(device)); err != nil {
+		logError.Printf("cannot remove lock file %v", err)
+	}
 }
 
 func connectMqtt() mqttClient.Client {
@@ -229,11 +1153,27 @@ func connectMqtt() mqttClient.Client {
 		AddBroker(config.MqttUrl).
 		SetClientID(config.MqttClientId).
 		SetOrderMatters(false).
-		SetKeepAlive(150 * time.Second).
-		SetAutoReconnect(true).
+		SetKeepAlive(config.MqttKeepAlive).
+		SetConnectTimeout(config.MqttConnectTimeout).
+		SetAutoReconnect(config.MqttAutoReconnect).
+		SetMaxReconnectInterval(config.MqttMaxReconnectInterval).
 		SetConnectionLostHandler(connectionLostHandler).
 		SetOnConnectHandler(connectHandler).
-		SetReconnectingHandler(reconnectHandler)
+		SetReconnectingHandler(reconnectHandler).
+		SetWill(topic(topicStatus), statusOffline, 1, config.RetainAvailability)
+
+	switch config.MqttVersion {
+	case "":
+		// paho tries 3.1.1 first and falls back to 3.1
+	case "3.1.1", "3", "4":
+		// 3 is the major version, 4 the protocol level of 3.1.1
+		opts = opts.SetProtocolVersion(4)
+	case "3.1":
+		opts = opts.SetProtocolVersion(3)
+	default:
+		// paho.mqtt.golang implements only 3.1 and 3.1.1, mqtt 5 needs a different client library
+		logError.Fatalf("unsupported mqtt version %s, supported versions are 3.1.1 and 3.1", config.MqttVersion)
+	}
 
 	if len(config.MqttUser) > 0 {
 		opts = opts.SetUsername(config.MqttUser)
@@ -243,6 +1183,14 @@ func connectMqtt() mqttClient.Client {
 		opts = opts.SetPassword(config.MqttPwd)
 	}
 
+	if isTlsUrl(config.MqttUrl) {
+		tlsConfig, err := newTlsConfig()
+		if err != nil {
+			logError.Fatalf("cannot configure mqtt tls: %v", err)
+		}
+		opts = opts.SetTLSConfig(tlsConfig)
+	}
+
 	logInfo.Printf("connecting to mqtt %s client id %s user %s", opts.Servers, opts.ClientID, opts.Username)
 
 	c := mqttClient.NewClient(opts)
@@ -253,18 +1201,271 @@ func connectMqtt() mqttClient.Client {
 	return c
 }
 
+// mirrorMqtt is the optional second broker receiving states, nil if not configured
+var mirrorMqtt mqttClient.Client
+
+// connectMirror connects to the mirror broker in background, states published while
+// the mirror is not connected are dropped so that it can not block publishing
+func connectMirror() {
+	if config.MirrorMqttUrl == "" {
+		return
+	}
+
+	opts := mqttClient.NewClientOptions().
+		AddBroker(config.MirrorMqttUrl).
+		SetClientID(config.MqttClientId + "-mirror").
+		SetUsername(config.MirrorMqttUser).
+		SetPassword(config.MirrorMqttPwd).
+		SetOrderMatters(false).
+		SetKeepAlive(config.MqttKeepAlive).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(config.MqttMaxReconnectInterval)
+
+	if isTlsUrl(config.MirrorMqttUrl) {
+		tlsConfig, err := newTlsConfig()
+		if err != nil {
+			logError.Fatalf("cannot configure mirror mqtt tls: %v", err)
+		}
+		opts = opts.SetTLSConfig(tlsConfig)
+	}
+
+	logInfo.Printf("connecting to mirror mqtt %s", opts.Servers)
+	mirrorMqtt = mqttClient.NewClient(opts)
+	mirrorMqtt.Connect()
+}
+
+func isTlsUrl(mqttUrl string) bool {
+	u, err := url.Parse(mqttUrl)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		return true
+	}
+	return false
+}
+
+func newTlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.MqttTlsInsecure}
+
+	if config.MqttCaCert != "" {
+		ca, err := os.ReadFile(config.MqttCaCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", config.MqttCaCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.MqttClientCert != "" || config.MqttClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.MqttClientCert, config.MqttClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
 func changeSpeedMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
 	body := string(msg.Payload())
 	topic := msg.Topic()
 	logInfo.Printf("received speed change %s to %s", body, topic)
-	spd, err := strconv.ParseInt(body, 0, 8)
+	if !checkWriteEnabled(mqtt, msg) {
+		return
+	}
+	spd, err := strconv.ParseInt(strings.TrimSpace(body), 0, 32)
 	if err != nil {
-		logError.Printf("cannot parse speed from body %s", body)
+		publishCommandError(mqtt, msg, fmt.Sprintf("cannot parse speed from body %s", body))
+		return
+	}
+	speed := clampSpeed(int(spd))
+	if int64(speed) != spd {
+		logError.Printf("speed %d out of range %d-8, using %d", spd, config.SpeedMin, speed)
+	}
+	speedUpdateRequest <- speed
+}
+
+// publishCommandError reports invalid command to error topic so that the sender
+// gets feedback instead of the command being silently ignored
+func publishCommandError(mqtt mqttClient.Client, msg mqttClient.Message, reason string) {
+	logError.Printf("invalid command to %s: %s", msg.Topic(), reason)
+
+	body, err := json.Marshal(map[string]string{
+		"topic":   msg.Topic(),
+		"payload": string(msg.Payload()),
+		"error":   reason,
+	})
+	if err != nil {
+		logError.Printf("cannot marshal json %v", err)
+		return
+	}
+	publish(mqtt, topic(topicCommandError), body)
+}
+
+// checkWriteEnabled reports command error if writing is not enabled, since vallox-rs485
+// silently ignores writes then and the speed would just snap back
+func checkWriteEnabled(mqtt mqttClient.Client, msg mqttClient.Message) bool {
+	if !config.EnableWrite {
+		publishCommandError(mqtt, msg, "writing is disabled, set ENABLE_WRITE=true to change speed")
+		return false
+	}
+	return true
+}
+
+func changeFanPercentageMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	body := string(msg.Payload())
+	logInfo.Printf("received fan percentage change %s to %s", body, msg.Topic())
+	if !checkWriteEnabled(mqtt, msg) {
+		return
+	}
+	pct, err := strconv.Atoi(body)
+	if err != nil {
+		publishCommandError(mqtt, msg, fmt.Sprintf("cannot parse percentage from body %s", body))
 	} else {
-		speedUpdateRequest <- byte(spd)
+		speedUpdateRequest <- percentageToSpeed(pct)
 	}
 }
 
+func changeFanStateMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	body := string(msg.Payload())
+	logInfo.Printf("received fan state change %s to %s", body, msg.Topic())
+	if !checkWriteEnabled(mqtt, msg) {
+		return
+	}
+	if body == "OFF" {
+		// Vallox fan can not be turned off, use the minimum speed instead
+		speedUpdateRequest <- config.SpeedMin
+	}
+}
+
+// speedToPercentage converts speed to percentage, linear unless SPEED_PERCENTAGES is configured
+func speedToPercentage(speed int16) int {
+	if len(config.SpeedPercentages) == 8 && speed >= 1 && speed <= 8 {
+		return config.SpeedPercentages[speed-1]
+	}
+	return int(speed) * 100 / 8
+}
+
+// percentageToSpeed returns the lowest speed giving at least the requested percentage, limited to SpeedMin-8
+func percentageToSpeed(pct int) byte {
+	if len(config.SpeedPercentages) == 8 {
+		for i, p := range config.SpeedPercentages {
+			if p >= pct {
+				return clampSpeed(i + 1)
+			}
+		}
+		return clampSpeed(8)
+	}
+	return clampSpeed((pct*8 + 99) / 100)
+}
+
+// clampSpeed limits speed to the allowed range SpeedMin-8
+func clampSpeed(speed int) byte {
+	if speed < int(config.SpeedMin) {
+		return config.SpeedMin
+	} else if speed > 8 {
+		return 8
+	}
+	return byte(speed)
+}
+
+func refreshMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	logInfo.Printf("received refresh request to %s", msg.Topic())
+	refreshRequest <- true
+}
+
+func boostMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	logInfo.Printf("received boost request to %s", msg.Topic())
+	boostRequest <- true
+}
+
+func boostSwitchMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	body := string(msg.Payload())
+	logInfo.Printf("received boost switch %s to %s", body, msg.Topic())
+	switch body {
+	case "ON":
+		boostRequest <- true
+	case "OFF":
+		boostRequest <- false
+	default:
+		publishCommandError(mqtt, msg, fmt.Sprintf("invalid boost switch value %s", body))
+	}
+}
+
+// startBoost sets maximum speed and returns timer for reverting it, nil if boost is not timed
+func startBoost(mqtt mqttClient.Client) <-chan time.Time {
+	if !boostActive {
+		boostRevertSpeed = currentSpeed
+	}
+	boostActive = true
+	logInfo.Printf("starting boost, reverting to speed %d after %v", boostRevertSpeed, config.BoostDuration)
+	requestSpeed(8)
+	publishState(mqtt, topic(topicBoost), "ON")
+
+	if config.BoostDuration > 0 {
+		return time.After(config.BoostDuration)
+	}
+	return nil
+}
+
+// stopBoost reverts speed to the one before boost was started
+func stopBoost(mqtt mqttClient.Client) {
+	if !boostActive {
+		return
+	}
+	boostActive = false
+	logInfo.Printf("stopping boost, reverting to speed %d", boostRevertSpeed)
+	if boostRevertSpeed != 0 {
+		requestSpeed(boostRevertSpeed)
+	}
+	publishState(mqtt, topic(topicBoost), "OFF")
+}
+
+const (
+	profileHome  = "Home"
+	profileAway  = "Away"
+	profileBoost = "Boost"
+)
+
+func profileMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	body := string(msg.Payload())
+	logInfo.Printf("received profile %s to %s", body, msg.Topic())
+	switch body {
+	case profileHome, profileAway, profileBoost:
+		profileRequest <- body
+	default:
+		publishCommandError(mqtt, msg, fmt.Sprintf("invalid profile %s", body))
+	}
+}
+
+// profileSpeed returns fan speed of home and away profiles
+func profileSpeed(profile string) byte {
+	if profile == profileAway {
+		return config.ProfileAwaySpeed
+	}
+	return config.ProfileHomeSpeed
+}
+
+// speedProfile returns profile matching the fan speed, empty if speed is not used by any profile
+func speedProfile(speed byte) string {
+	switch speed {
+	case config.ProfileHomeSpeed:
+		return profileHome
+	case config.ProfileAwaySpeed:
+		return profileAway
+	case 8:
+		return profileBoost
+	}
+	return ""
+}
+
 func haStatusMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
 	body := string(msg.Payload())
 	homeassistantStatus <- body
@@ -272,44 +1473,296 @@ func haStatusMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
 
 func subscribe(mqtt mqttClient.Client) {
 	logDebug.Print("subscribing to topics")
-	mqtt.Subscribe("homeassistant/status", 0, haStatusMessage)
-	mqtt.Subscribe(topic(topicFanSpeedSet), 0, changeSpeedMessage)
+	mqtt.Subscribe(config.HaStatusTopic, 0, haStatusMessage)
+	mqtt.Subscribe(topic(config.FanCommandTopic), 0, changeSpeedMessage)
+	if config.FanEntity {
+		mqtt.Subscribe(topic(topicFanPercentageSet), 0, changeFanPercentageMessage)
+		mqtt.Subscribe(topic(topicFanStateSet), 0, changeFanStateMessage)
+	}
+	mqtt.Subscribe(topic(topicRefresh), 0, refreshMessage)
+	mqtt.Subscribe(topic(topicDiagnose), 0, diagnoseMessage)
+	if config.EnableWrite {
+		mqtt.Subscribe(topic(topicBoostStart), 0, boostMessage)
+		mqtt.Subscribe(topic(topicBoostSet), 0, boostSwitchMessage)
+		mqtt.Subscribe(topic(topicProfileSet), 0, profileMessage)
+	}
 }
 
-func queryValues(device *vallox.Vallox, cache map[byte]cacheEntry) {
+func queryValues(cache map[byte]cacheEntry) {
 	// Speed is not automatically published by Vallox, so manually refresh the value
 	logDebug.Printf("scheduled register query")
 	now := time.Now()
-	validTime := now.Add(time.Duration(-15) * time.Minute)
-	for register, _ := range topicMap {
+	validTime := now.Add(-config.PollInterval)
+	for register := range queryRegisters() {
+		if time.Since(lastQueried[register]) < time.Minute {
+			// recently queried, waiting for response
+			continue
+		}
 		if cached, ok := cache[register]; !ok || cached.time.Before(validTime) {
-			// more than 15min old, query it
-			device.Query(register)
+			// older than poll interval, query it
+			enqueueQuery(register)
 		}
 	}
 }
 
+// enqueueQuery adds register to be queried, queries are sent one at a time
+// with QueryDelay between them to avoid collisions on the bus
+func enqueueQuery(register byte) {
+	if slices.Contains(queryQueue, register) {
+		return
+	}
+	queryQueue = append(queryQueue, register)
+}
+
+func sendQuery(device valloxClient) {
+	if len(queryQueue) == 0 {
+		return
+	}
+	register := queryQueue[0]
+	queryQueue = queryQueue[1:]
+	lastQueried[register] = time.Now()
+	device.Query(register)
+}
+
+// queryRegisters returns registers to query.  Until protocol is detected from broadcasts
+// only registers common to both protocols are queried, so that a reply from the other
+// protocol's address can not be published as a value.
+func queryRegisters() map[byte]string {
+	registers := make(map[byte]string)
+	for register := range flagMap {
+		registers[register] = ""
+	}
+	for register, t := range topicMap {
+		if _, inNew := topicMapNew[register]; !protocolDetected && !inNew {
+			continue
+		}
+		registers[register] = t
+	}
+	return registers
+}
+
+func queryAllValues() {
+	logDebug.Printf("querying all registers")
+	for register := range queryRegisters() {
+		enqueueQuery(register)
+	}
+}
+
 func publishValue(mqtt mqttClient.Client, event vallox.Event) {
 
 	if t, ok := topicMap[event.Register]; ok {
-		publish(mqtt, topic(t), fmt.Sprintf("%d", event.Value))
+		publishState(mqtt, topic(t), formatValue(event))
+	}
+
+	for mask, t := range flagMap[event.Register] {
+		publishState(mqtt, topic(t), formatFlag(event.RawValue&mask != 0))
+	}
+
+	if event.Register == vallox.FanSpeed {
+		publishState(mqtt, topic(topicFanSpeedPercent), fmt.Sprintf("%d", speedToPercentage(event.Value)))
+	}
+
+	if event.Register == vallox.FanSpeed && config.EnableWrite {
+		if profile := speedProfile(byte(event.Value)); profile != "" {
+			publishState(mqtt, topic(topicProfile), profile)
+		}
 	}
 
-	if config.EnableRaw {
-		publish(mqtt, topic(fmt.Sprintf(topicRaw, event.Register)), fmt.Sprintf("%d", event.RawValue))
+	if event.Register == vallox.FanSpeed && config.FanEntity {
+		publishState(mqtt, topic(topicFanPercentage), fmt.Sprintf("%d", speedToPercentage(event.Value)))
+		publishState(mqtt, topic(topicFanState), "ON")
+	}
+
+	if config.EnableRaw && config.RawJson {
+		publishState(mqtt, topic(fmt.Sprintf(topicRaw, event.Register)), rawJson(event))
+	} else if config.EnableRaw {
+		publishState(mqtt, topic(fmt.Sprintf(topicRaw, event.Register)), fmt.Sprintf("%d", event.RawValue))
 	}
 }
 
-func publish(mqtt mqttClient.Client, topic string, msg interface{}) {
-	logDebug.Printf("publishing to %s msg %s", msg, topic)
+// rawJson returns raw register value with value decoded by vallox-rs485, and
+// formatted value and topic if the register is known
+func rawJson(event vallox.Event) []byte {
+	raw := map[string]any{
+		"register": fmt.Sprintf("0x%02x", event.Register),
+		"raw":      event.RawValue,
+		"value":    event.Value,
+	}
+	if t, ok := topicMap[event.Register]; ok {
+		raw["topic"] = t
+		raw["formatted"] = formatValue(event)
+	}
 
-	t := mqtt.Publish(topic, 0, false, msg)
-	go func() {
-		_ = t.Wait()
-		if t.Error() != nil {
-			logError.Printf("publishing msg failed %v", t.Error())
+	body, err := json.Marshal(raw)
+	if err != nil {
+		logError.Printf("cannot marshal json %v", err)
+	}
+	return body
+}
+
+// publishStateJson publishes all known values as single retained json object
+func publishStateJson(mqtt mqttClient.Client, cache map[byte]cacheEntry) {
+	state := make(map[string]any)
+	// time of the latest value from the unit, to notice registers that have stopped updating
+	lastSeen := make(map[string]string)
+	state["last_seen"] = lastSeen
+	for register, cached := range cache {
+		if t, ok := topicMap[register]; ok {
+			lastSeen[jsonKey(t)] = cached.time.Format(time.RFC3339)
+			value := formatValue(cached.value)
+			if number, err := strconv.ParseFloat(value, 64); err == nil {
+				state[jsonKey(t)] = number
+			} else {
+				state[jsonKey(t)] = value
+			}
 		}
-	}()
+		for mask, t := range flagMap[register] {
+			state[jsonKey(t)] = cached.value.RawValue&mask != 0
+			lastSeen[jsonKey(t)] = cached.time.Format(time.RFC3339)
+		}
+	}
+
+	body, err := json.Marshal(state)
+	if err != nil {
+		logError.Printf("cannot marshal json %v", err)
+		return
+	}
+	publishWith(mqtt, topic(topicState), 0, true, body)
+}
+
+func jsonKey(t string) string {
+	return strings.ReplaceAll(t, "/", "_")
+}
+
+func formatFlag(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// formatValue converts event value to the published format
+func formatValue(event vallox.Event) string {
+	if isTemperature(event.Register) {
+		return formatTemperature(event.Value)
+	}
+
+	switch event.Register {
+	case co2SensorsInstalled:
+		// Vallox only reports highest co2 value, so number of sensors is all we can tell
+		return fmt.Sprintf("%d", bits.OnesCount8(event.RawValue&0x3e))
+	case faultCode:
+		if desc, ok := faultDescriptions[event.RawValue]; ok {
+			return desc
+		}
+		return fmt.Sprintf("unknown fault %d", event.RawValue)
+	case heatingSetpoint, bypassTemperature:
+		return formatTemperature(ntcTemperature(event.RawValue))
+	case humidityBasicLevel:
+		// vallox-rs485 converts only humidity sensor registers to percentage
+		return fmt.Sprintf("%.0f", (float64(event.RawValue)-51)/2.04)
+	default:
+		return fmt.Sprintf("%d", event.Value)
+	}
+}
+
+// isTemperature returns true for temperature registers of the selected protocol
+func isTemperature(register byte) bool {
+	return strings.HasPrefix(topicMap[register], "temp/")
+}
+
+// formatTemperature formats temperature in configured unit with one decimal.  vallox-rs485 decodes
+// the raw NTC sensor value with lookup table, so value is always in whole degrees celsius.
+func formatTemperature(celsius int16) string {
+	value := float64(celsius)
+	if config.TemperatureUnit == "F" {
+		value = value*9/5 + 32
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64)
+}
+
+func temperatureUnit() string {
+	if config.TemperatureUnit == "F" {
+		return unitFahrenheit
+	}
+	return unitCelsius
+}
+
+func publish(mqtt mqttClient.Client, topic string, msg interface{}) {
+	publishWith(mqtt, topic, 0, false, msg)
+}
+
+// publishState publishes entity state, retained if configured so that it survives broker restart
+func publishState(mqtt mqttClient.Client, topic string, msg interface{}) {
+	publishWith(mqtt, topic, 0, config.RetainState, msg)
+	if mirrorMqtt != nil && mirrorMqtt.IsConnectionOpen() {
+		publishWith(mirrorMqtt, topic, 0, config.RetainState, msg)
+	}
+}
+
+type queuedPublish struct {
+	mqtt   mqttClient.Client
+	topic  string
+	qos    byte
+	retain bool
+	msg    interface{}
+}
+
+// number of workers publishing and waiting for completion, and size of the queue for each,
+// so that unreachable broker can not pile up goroutines
+const (
+	publishWorkers   = 4
+	publishQueueSize = 125
+)
+
+// queue for each worker, messages to the same topic always go through the same queue
+// so that they are published in order
+var publishQueues = newPublishQueues()
+
+func newPublishQueues() (queues [publishWorkers]chan queuedPublish) {
+	for i := range queues {
+		queues[i] = make(chan queuedPublish, publishQueueSize)
+	}
+	return queues
+}
+
+// startPublishers starts workers publishing messages from the queues
+func startPublishers() {
+	for _, queue := range publishQueues {
+		go func() {
+			for r := range queue {
+				t := r.mqtt.Publish(r.topic, r.qos, r.retain, r.msg)
+				_ = t.Wait()
+				if t.Error() != nil {
+					metricPublishErrors.Inc()
+					countPublishErrors.Add(1)
+					logError.Printf("publishing msg failed %v", t.Error())
+				} else {
+					countPublished.Add(1)
+				}
+			}
+		}()
+	}
+}
+
+func publishWith(mqtt mqttClient.Client, topic string, qos byte, retain bool, msg interface{}) {
+	logDebug.Printf("publishing to %s msg %s", topic, msg)
+
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	select {
+	case publishQueues[h.Sum32()%publishWorkers] <- queuedPublish{mqtt: mqtt, topic: topic, qos: qos, retain: retain, msg: msg}:
+	default:
+		metricPublishErrors.Inc()
+		countPublishErrors.Add(1)
+		logError.Printf("publish queue full, dropping msg to %s", topic)
+	}
+}
+
+// publishAvailability publishes bridge status, retained by default so that clients
+// connecting later see the current status
+func publishAvailability(mqtt mqttClient.Client, status string) {
+	publishWith(mqtt, topic(topicStatus), 1, config.RetainAvailability, status)
 }
 
 func discoveryMsg(uid string, name string, stateTopic string, commandTopic string) []byte {
@@ -317,15 +1770,30 @@ func discoveryMsg(uid string, name string, stateTopic string, commandTopic strin
 	msg["unique_id"] = toUid(uid)
 	msg["name"] = name
 	if config.ObjectId {
-		msg["object_id"] = toUid(uid)
+		msg["object_id"] = objectId(uid)
 	}
 
 	dev := make(map[string]string)
 	msg["device"] = dev
-	dev["identifiers"] = config.DeviceId
-	dev["manufacturer"] = "Vallox"
+	dev["identifiers"] = deviceIdentifier()
+	dev["manufacturer"] = config.DeviceManufacturer
 	dev["name"] = config.DeviceName
-	dev["model"] = "Digit SE"
+	dev["model"] = config.DeviceModel
+	dev["sw_version"] = version
+	if config.ConfigurationUrl != "" {
+		dev["configuration_url"] = config.ConfigurationUrl
+	}
+
+	if config.AvailabilityLink && !bridgeEntities[uid] {
+		// values from the unit are available only when both bridge and the unit are up
+		msg["availability"] = []map[string]string{
+			{"topic": topic(topicStatus), "payload_available": statusOnline, "payload_not_available": statusOffline},
+			{"topic": topic(topicLink), "payload_available": formatFlag(true), "payload_not_available": formatFlag(false)},
+		}
+		msg["availability_mode"] = "all"
+	} else {
+		msg["availability_topic"] = topic(topicStatus)
+	}
 
 	if stateTopic != "" {
 		msg["state_topic"] = topic(stateTopic)
@@ -334,7 +1802,12 @@ func discoveryMsg(uid string, name string, stateTopic string, commandTopic strin
 		msg["command_topic"] = topic(commandTopic)
 	}
 
-	if uid == "fan_select" {
+	if uid == "fan_number" {
+		msg["min"] = int(config.SpeedMin)
+		msg["max"] = 8
+		msg["step"] = 1
+		msg["icon"] = "mdi:fan"
+	} else if uid == "fan_select" {
 		min := int(config.SpeedMin)
 		var options []string
 		for i := min; i <= 8; i++ {
@@ -342,15 +1815,97 @@ func discoveryMsg(uid string, name string, stateTopic string, commandTopic strin
 		}
 		msg["options"] = options
 		msg["icon"] = "mdi:fan"
+	} else if uid == "profile" {
+		msg["options"] = []string{profileHome, profileAway, profileBoost}
+		msg["icon"] = "mdi:home-account"
+	} else if uid == "fan" {
+		msg["percentage_state_topic"] = topic(topicFanPercentage)
+		msg["percentage_command_topic"] = topic(topicFanPercentageSet)
+		msg["icon"] = "mdi:fan"
 	} else if uid == "fan_speed" {
-		msg["expire_after"] = 1800
 		msg["icon"] = "mdi:fan"
 		msg["state_class"] = "measurement"
+	} else if uid == "refresh" {
+		msg["icon"] = "mdi:refresh"
+	} else if uid == "boost" || uid == "boost_switch" {
+		msg["icon"] = "mdi:fan-plus"
+	} else if uid == "co2_highest" {
+		msg["unit_of_measurement"] = "ppm"
+		msg["state_class"] = "measurement"
+		msg["device_class"] = "carbon_dioxide"
+	} else if uid == "co2_sensors" {
+		msg["icon"] = "mdi:molecule-co2"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "service_reminder" {
+		msg["device_class"] = "problem"
+		msg["icon"] = "mdi:air-filter"
+	} else if uid == "service_remaining" {
+		// HA duration device class does not support months
+		msg["unit_of_measurement"] = "months"
+		msg["icon"] = "mdi:calendar-clock"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "heating_setpoint" || uid == "bypass_temperature" {
+		msg["unit_of_measurement"] = temperatureUnit()
+		msg["device_class"] = "temperature"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "humidity_setpoint" {
+		msg["unit_of_measurement"] = "%"
+		msg["icon"] = "mdi:water-percent"
+		msg["entity_category"] = "diagnostic"
+	} else if strings.HasPrefix(uid, "raw_") {
+		msg["entity_category"] = "diagnostic"
+		if config.RawJson {
+			msg["value_template"] = "{{ value_json.raw }}"
+			msg["json_attributes_topic"] = topic(stateTopic)
+		}
+	} else if strings.HasPrefix(uid, "counter_") {
+		msg["state_class"] = "total_increasing"
+		msg["icon"] = "mdi:counter"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "defrost" {
+		msg["device_class"] = "cold"
+		msg["icon"] = "mdi:snowflake-melt"
+	} else if uid == "heating" {
+		msg["device_class"] = "heat"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "link" || uid == "mqtt_connected" {
+		msg["device_class"] = "connectivity"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "bypass" {
+		msg["icon"] = "mdi:valve"
+	} else if uid == "post_heating" {
+		msg["device_class"] = "heat"
+	} else if uid == "fault" {
+		msg["icon"] = "mdi:alert-circle"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "version" {
+		msg["icon"] = "mdi:tag"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "serial_number" {
+		msg["icon"] = "mdi:identifier"
+		msg["entity_category"] = "diagnostic"
+	} else if uid == "fan_supply" || uid == "fan_exhaust" || uid == "fan_speed_percent" {
+		msg["unit_of_measurement"] = "%"
+		msg["state_class"] = "measurement"
+		msg["icon"] = "mdi:fan"
 	} else if strings.HasPrefix(uid, "temp_") {
-		msg["unit_of_measurement"] = "°C"
+		msg["unit_of_measurement"] = temperatureUnit()
 		msg["state_class"] = "measurement"
-		msg["expire_after"] = 1800
 		msg["device_class"] = "temperature"
+	} else if strings.HasPrefix(uid, "rh_") {
+		// vallox-rs485 already converts the raw value to percentage
+		msg["unit_of_measurement"] = "%"
+		msg["state_class"] = "measurement"
+		msg["device_class"] = "humidity"
+	} else if uid == "efficiency" || strings.HasPrefix(uid, "efficiency_") {
+		msg["unit_of_measurement"] = "%"
+		msg["state_class"] = "measurement"
+		msg["icon"] = "mdi:heat-wave"
+	}
+
+	if pollDriven[uid] {
+		// polled values can go missing if the query fails, let HA expire them
+		msg["expire_after"] = int(expireAfter().Seconds())
 	}
 
 	jsonm, err := json.Marshal(msg)
@@ -360,19 +1915,82 @@ func discoveryMsg(uid string, name string, stateTopic string, commandTopic strin
 	return jsonm
 }
 
+// expireAfter returns configured expiration of polled values, by default two poll
+// intervals so that a single failed query does not make the entity unavailable
+func expireAfter() time.Duration {
+	if config.ExpireAfter > 0 {
+		return config.ExpireAfter
+	}
+	return 2 * config.PollInterval
+}
+
 func announceMeToMqttDiscovery(mqtt mqttClient.Client, cache map[byte]cacheEntry) {
+	announcedLock.Lock()
 	announced = make(map[string]any)
+	announcedLock.Unlock()
 
 	publishSensor(mqtt, "fan_speed", "speed", topicFanSpeed)
-	publishSelect(mqtt, "fan_select", "speed select", topicFanSpeed, topicFanSpeedSet)
+	if config.FanEntity {
+		publishFan(mqtt, "fan", "fan", topicFanState, topicFanStateSet)
+	} else {
+		publishSelect(mqtt, "fan_select", "speed select", topicFanSpeed, config.FanCommandTopic)
+	}
+	if config.FanNumber {
+		publishNumber(mqtt, "fan_number", "speed", topicFanSpeed, config.FanCommandTopic)
+	}
+	publishSensor(mqtt, "fan_speed_percent", "speed percentage", topicFanSpeedPercent)
+	publishSensor(mqtt, "fan_supply", "supply fan balance", topicFanSupply)
+	publishSensor(mqtt, "fan_exhaust", "exhaust fan balance", topicFanExhaust)
 	publishSensor(mqtt, "temp_incoming_outside", "outdoor temperature", topicTempIncomingOutside)
 	publishSensor(mqtt, "temp_incoming_insise", "incoming temperature", topicTempIncomingIside)
 	publishSensor(mqtt, "temp_outgoing_inside", "interior temperature", topicTempOutgoingInside)
 	publishSensor(mqtt, "temp_outgoing_outside", "exhaust temperature", topicTempOutgoingOutside)
+	publishSensor(mqtt, "rh_highest", "highest humidity", topicRhHighest)
+	publishSensor(mqtt, "rh_sensor1", "humidity sensor 1", topicRh1)
+	publishSensor(mqtt, "rh_sensor2", "humidity sensor 2", topicRh2)
+	publishSensor(mqtt, "co2_highest", "highest co2", topicCo2Highest)
+	publishSensor(mqtt, "humidity_setpoint", "humidity setpoint", topicRhSetpoint)
+	publishSensor(mqtt, "efficiency", "heat recovery efficiency", topicEfficiency)
+	publishSensor(mqtt, "efficiency_exhaust", "exhaust heat recovery efficiency", topicEfficiencyExhaust)
+	publishSensor(mqtt, "co2_sensors", "co2 sensors installed", topicCo2Sensors)
+	publishSensor(mqtt, "fault", "fault", topicFault)
+	publishBinarySensor(mqtt, "post_heating", "post heating", topicPostHeating)
+	publishBinarySensor(mqtt, "heating", "heating", topicHeating)
+	publishSensor(mqtt, "heating_setpoint", "supply air setpoint", topicHeatingSetpoint)
+	publishBinarySensor(mqtt, "bypass", "summer bypass", topicBypass)
+	publishSensor(mqtt, "bypass_temperature", "summer bypass temperature", topicBypassTemperature)
+	publishBinarySensor(mqtt, "defrost", "defrost", topicDefrost)
+	publishSensor(mqtt, "service_remaining", "service remaining", topicServiceRemaining)
+	publishBinarySensor(mqtt, "service_reminder", "service reminder", topicServiceReminder)
+	publishBinarySensor(mqtt, "link", "rs485 link", topicLink)
+	publishBinarySensor(mqtt, "mqtt_connected", "mqtt connected", topicMqttConnected)
+	publishSensor(mqtt, "counter_events", "events received", topicCounterEvents)
+	publishSensor(mqtt, "counter_published", "values published", topicCounterPublished)
+	publishSensor(mqtt, "counter_publish_errors", "publish errors", topicPublishErrors)
+	publishSensor(mqtt, "counter_serial_errors", "serial errors", topicSerialErrors)
+	publishSensor(mqtt, "counter_mqtt_reconnects", "mqtt reconnects", topicMqttReconnects)
+	publishButton(mqtt, "refresh", "refresh", topicRefresh)
+	if config.EnableWrite {
+		publishButton(mqtt, "boost", "boost", topicBoostStart)
+		publishSwitch(mqtt, "boost_switch", "boost active", topicBoost, topicBoostSet)
+		publishSelect(mqtt, "profile", "profile", topicProfile, topicProfileSet)
+	}
+
+	publishSensor(mqtt, "version", "bridge version", topicVersion)
+	publishState(mqtt, topic(topicVersion), version)
+
+	if config.DeviceSerial != "" {
+		publishSensor(mqtt, "serial_number", "serial number", topicSerialNumber)
+		publishState(mqtt, topic(topicSerialNumber), config.DeviceSerial)
+	}
 
 	for reg := range cache {
 		announceRawData(mqtt, reg)
 	}
+	// co2 bytes are combined by vallox-rs485, announce both so that raw bytes can be compared
+	// to the combined value even before both have been received
+	announceRawData(mqtt, vallox.Co2HighestHighByte)
+	announceRawData(mqtt, vallox.Co2HighestLowByte)
 }
 
 func announceRawData(mqtt mqttClient.Client, register byte) {
@@ -389,47 +2007,149 @@ func publishSensor(mqtt mqttClient.Client, uid string, name string, stateTopic s
 	publishDiscovery(mqtt, "sensor", uid, name, stateTopic, "")
 }
 
+func publishBinarySensor(mqtt mqttClient.Client, uid string, name string, stateTopic string) {
+	publishDiscovery(mqtt, "binary_sensor", uid, name, stateTopic, "")
+}
+
 func publishSelect(mqtt mqttClient.Client, uid string, name string, stateTopic string, cmdTopic string) {
 	publishDiscovery(mqtt, "select", uid, name, stateTopic, cmdTopic)
 }
 
+func publishFan(mqtt mqttClient.Client, uid string, name string, stateTopic string, cmdTopic string) {
+	publishDiscovery(mqtt, "fan", uid, name, stateTopic, cmdTopic)
+}
+
+func publishNumber(mqtt mqttClient.Client, uid string, name string, stateTopic string, cmdTopic string) {
+	publishDiscovery(mqtt, "number", uid, name, stateTopic, cmdTopic)
+}
+
+func publishSwitch(mqtt mqttClient.Client, uid string, name string, stateTopic string, cmdTopic string) {
+	publishDiscovery(mqtt, "switch", uid, name, stateTopic, cmdTopic)
+}
+
+func publishButton(mqtt mqttClient.Client, uid string, name string, cmdTopic string) {
+	publishDiscovery(mqtt, "button", uid, name, "", cmdTopic)
+}
+
 func publishDiscovery(mqtt mqttClient.Client, etype string, uid string, name string, stateTopic string, cmdTopic string) {
 	discoveryTopic := fmt.Sprintf("homeassistant/%s/%s/config", etype, toUid(uid))
-	if _, ok := announced[stateTopic]; ok {
+	announcedLock.Lock()
+	_, ok := announced[discoveryTopic]
+	announced[discoveryTopic] = true
+	announcedLock.Unlock()
+	if ok {
 		// already announced
 		return
 	}
-	announced[stateTopic] = true
+	if slices.Contains(config.DisabledEntities, uid) {
+		// empty config removes entity from Home Assistant if it was announced earlier
+		publishWith(mqtt, discoveryTopic, config.DiscoveryQos, true, "")
+		return
+	}
+	if override, ok := config.EntityNames[uid]; ok {
+		name = override
+	}
 	msg := discoveryMsg(uid, name, stateTopic, cmdTopic)
-	publish(mqtt, discoveryTopic, msg)
+	publishWith(mqtt, discoveryTopic, config.DiscoveryQos, config.RetainDiscovery, msg)
 }
 
 func connectionLostHandler(client mqttClient.Client, err error) {
 	options := client.OptionsReader()
 	logError.Printf("MQTT connection to %s lost %v", options.Servers(), err)
+	mqttConnected.Store(false)
+	metricMqttConnected.Set(0)
 }
 
 func connectHandler(client mqttClient.Client) {
 	options := client.OptionsReader()
 	logInfo.Printf("MQTT connected to %s", options.Servers())
+	mqttConnected.Store(true)
+	reconnectAttempts.Store(0)
+	metricMqttConnected.Set(1)
 	subscribe(client)
+	publishAvailability(client, statusOnline)
+	// retained so that it shows the last known state, set OFF on clean shutdown, broken
+	// connections are visible in status which is set offline by the broker
+	publishWith(client, topic(topicMqttConnected), 1, true, formatFlag(true))
 }
 
+// attempts since connection was lost, paho doubles the delay between attempts up to MQTT_MAX_RECONNECT_INTERVAL
+var reconnectAttempts atomic.Int64
+
 func reconnectHandler(client mqttClient.Client, options *mqttClient.ClientOptions) {
-	logInfo.Printf("MQTT reconnecting to %s", options.Servers)
+	attempt := reconnectAttempts.Add(1)
+	countReconnects.Add(1)
+	metricMqttReconnects.Inc()
+	logInfo.Printf("MQTT reconnecting to %s, attempt %d, max interval %v", options.Servers, attempt, options.MaxReconnectInterval)
 }
 
 func initLogging() {
 	writer := os.Stdout
 	err := os.Stderr
 
-	if config.Debug {
+	if config.LogFormat == "json" {
+		logDebug = log.New(jsonLogWriter{out: writer, level: "debug"}, "", 0)
+		logInfo = log.New(jsonLogWriter{out: writer, level: "info"}, "", 0)
+		logError = log.New(jsonLogWriter{out: err, level: "error"}, "", 0)
+	} else if config.LogFormat == "text" {
 		logDebug = log.New(writer, "DEBUG ", log.Ldate|log.Ltime|log.Lmsgprefix)
+		logInfo = log.New(writer, "INFO  ", log.Ldate|log.Ltime|log.Lmsgprefix)
+		logError = log.New(err, "ERROR ", log.Ldate|log.Ltime|log.Lmsgprefix)
 	} else {
-		logDebug = log.New(io.Discard, "DEBUG ", 0)
+		log.Fatalf("unknown log format %s", config.LogFormat)
 	}
-	logInfo = log.New(writer, "INFO  ", log.Ldate|log.Ltime|log.Lmsgprefix)
-	logError = log.New(err, "ERROR ", log.Ldate|log.Ltime|log.Lmsgprefix)
+
+	level := config.LogLevel
+	if config.Debug {
+		// DEBUG=true is kept for backward compatibility
+		level = "debug"
+	}
+
+	switch level {
+	case "debug":
+	case "info":
+		logDebug.SetOutput(io.Discard)
+	case "error":
+		logDebug.SetOutput(io.Discard)
+		logInfo.SetOutput(io.Discard)
+	default:
+		log.Fatalf("unknown log level %s", level)
+	}
+}
+
+// jsonLogWriter writes each log message as json line with timestamp and level
+type jsonLogWriter struct {
+	out   io.Writer
+	level string
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(map[string]string{
+		"time":  time.Now().Format(time.RFC3339),
+		"level": w.level,
+		"msg":   strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// deviceIdentifier returns HA device identity, serial number is preferred since it
+// stays the same even if device id is changed
+func deviceIdentifier() string {
+	if config.DeviceSerial != "" {
+		return config.DeviceSerial
+	}
+	return config.DeviceId
+}
+
+// objectId returns HA object id from the template, {device_id} and {uid} are replaced
+func objectId(uid string) string {
+	return strings.NewReplacer("{device_id}", config.DeviceId, "{uid}", uid).Replace(config.ObjectIdTemplate)
 }
 
 func toUid(uid string) string {
@@ -437,5 +2157,5 @@ func toUid(uid string) string {
 }
 
 func topic(topic string) string {
-	return config.DeviceId + "/" + topic
+	return config.TopicPrefix + "/" + topic
 }
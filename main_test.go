@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	vallox "github.com/pvainio/vallox-rs485"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("VALLOX_MQTT_URL", "tcp://localhost:1883")
+	os.Setenv("VALLOX_SIMULATE", "true")
+	os.Setenv("VALLOX_LOG_LEVEL", "error")
+	loadConfig()
+	os.Exit(m.Run())
+}
+
+// withConfig restores configuration after the test so that tests can change it freely
+func withConfig(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+}
+
+func TestFormatTemperature(t *testing.T) {
+	tests := []struct {
+		unit    string
+		celsius int16
+		want    string
+	}{
+		{"C", 0, "0.0"},
+		{"C", 21, "21.0"},
+		{"C", -5, "-5.0"},
+		{"F", 0, "32.0"},
+		{"F", 21, "69.8"},
+		{"F", -40, "-40.0"},
+		{"F", 100, "212.0"},
+	}
+	withConfig(t)
+	for _, tt := range tests {
+		config.TemperatureUnit = tt.unit
+		if got := formatTemperature(tt.celsius); got != tt.want {
+			t.Errorf("formatTemperature(%d) in %s = %s, want %s", tt.celsius, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestFormatValueTemperature(t *testing.T) {
+	tests := []struct {
+		unit  string
+		event vallox.Event
+		want  string
+	}{
+		// temperature registers are decoded by vallox-rs485
+		{"C", vallox.Event{Register: vallox.TempIncomingOutside, RawValue: 100, Value: 0}, "0.0"},
+		{"C", vallox.Event{Register: vallox.TempOutgoingInside, RawValue: 165, Value: 21}, "21.0"},
+		{"F", vallox.Event{Register: vallox.TempOutgoingInside, RawValue: 165, Value: 21}, "69.8"},
+		// setpoints are decoded here from the raw value
+		{"C", vallox.Event{Register: heatingSetpoint, RawValue: 150, Value: 150}, "16.0"},
+		{"F", vallox.Event{Register: heatingSetpoint, RawValue: 150, Value: 150}, "60.8"},
+		{"C", vallox.Event{Register: bypassTemperature, RawValue: 128, Value: 128}, "9.0"},
+	}
+	withConfig(t)
+	for _, tt := range tests {
+		config.TemperatureUnit = tt.unit
+		if got := formatValue(tt.event); got != tt.want {
+			t.Errorf("formatValue(%x raw %d) in %s = %s, want %s", tt.event.Register, tt.event.RawValue, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestDiscoveryMsg(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func()
+		uid     string
+		state   string
+		command string
+		want    map[string]any
+		absent  []string
+	}{
+		{
+			name:  "fan select options start from minimum speed",
+			setup: func() { config.SpeedMin = 3 },
+			uid:   "fan_select",
+			want:  map[string]any{"options": []any{"3", "4", "5", "6", "7", "8"}},
+		},
+		{
+			name:  "fan number range",
+			setup: func() { config.SpeedMin = 2 },
+			uid:   "fan_number",
+			want:  map[string]any{"min": 2.0, "max": 8.0, "step": 1.0},
+		},
+		{
+			name:  "temperature in celsius",
+			setup: func() { config.TemperatureUnit = "C" },
+			uid:   "temp_incoming_outside",
+			want:  map[string]any{"unit_of_measurement": unitCelsius, "device_class": "temperature"},
+		},
+		{
+			name:  "temperature in fahrenheit",
+			setup: func() { config.TemperatureUnit = "F" },
+			uid:   "temp_incoming_outside",
+			want:  map[string]any{"unit_of_measurement": unitFahrenheit, "device_class": "temperature"},
+		},
+		{
+			name:  "unit entity requires bridge and link",
+			setup: func() { config.AvailabilityLink = true },
+			uid:   "temp_incoming_outside",
+			want: map[string]any{
+				"availability": []any{
+					map[string]any{"topic": "vallox/status", "payload_available": "online", "payload_not_available": "offline"},
+					map[string]any{"topic": "vallox/link", "payload_available": "ON", "payload_not_available": "OFF"},
+				},
+				"availability_mode": "all",
+			},
+			absent: []string{"availability_topic"},
+		},
+		{
+			name:   "bridge entity requires only bridge",
+			setup:  func() { config.AvailabilityLink = true },
+			uid:    "link",
+			want:   map[string]any{"availability_topic": "vallox/status"},
+			absent: []string{"availability", "availability_mode"},
+		},
+		{
+			name:   "link availability disabled",
+			setup:  func() { config.AvailabilityLink = false },
+			uid:    "temp_incoming_outside",
+			want:   map[string]any{"availability_topic": "vallox/status"},
+			absent: []string{"availability", "availability_mode"},
+		},
+		{
+			name:  "polled entity expires after two poll intervals",
+			setup: func() { config.PollInterval, config.ExpireAfter = 15*time.Minute, 0 },
+			uid:   "fan_speed",
+			want:  map[string]any{"expire_after": 1800.0},
+		},
+		{
+			name:  "polled entity expires after configured time",
+			setup: func() { config.ExpireAfter = 10 * time.Minute },
+			uid:   "fan_speed_percent",
+			want:  map[string]any{"expire_after": 600.0},
+		},
+		{
+			name:    "fan select topics",
+			setup:   func() {},
+			uid:     "fan_select",
+			state:   topicFanSpeed,
+			command: "fan/set",
+			want:    map[string]any{"state_topic": "vallox/fan/speed", "command_topic": "vallox/fan/set"},
+		},
+		{
+			name:    "fan number topics",
+			setup:   func() {},
+			uid:     "fan_number",
+			state:   topicFanSpeed,
+			command: "fan/set",
+			want:    map[string]any{"state_topic": "vallox/fan/speed", "command_topic": "vallox/fan/set"},
+		},
+		{
+			name:    "button has only command topic",
+			setup:   func() {},
+			uid:     "refresh",
+			command: topicRefresh,
+			want:    map[string]any{"command_topic": "vallox/refresh"},
+			absent:  []string{"state_topic"},
+		},
+		{
+			name:    "switch topics",
+			setup:   func() {},
+			uid:     "boost_switch",
+			state:   topicBoost,
+			command: topicBoostSet,
+			want:    map[string]any{"state_topic": "vallox/boost", "command_topic": "vallox/boost/set"},
+		},
+		{
+			name:   "sensor has no command topic",
+			setup:  func() {},
+			uid:    "temp_incoming_outside",
+			state:  topicTempIncomingOutside,
+			want:   map[string]any{"state_topic": "vallox/temp/incoming/outside"},
+			absent: []string{"command_topic"},
+		},
+		{
+			name: "device identified by device id",
+			setup: func() {
+				config.DeviceSerial, config.DeviceModel, config.ConfigurationUrl = "", "Digit SE", ""
+			},
+			uid: "temp_incoming_outside",
+			want: map[string]any{"device": map[string]any{
+				"identifiers":  "vallox",
+				"manufacturer": "Vallox",
+				"name":         "Vallox",
+				"model":        "Digit SE",
+				"sw_version":   version,
+			}},
+		},
+		{
+			name: "device identified by serial number",
+			setup: func() {
+				config.DeviceSerial, config.DeviceModel, config.ConfigurationUrl = "1234", "Digit SE 2", "http://vallox.local"
+			},
+			uid: "fan_select",
+			want: map[string]any{"device": map[string]any{
+				"identifiers":       "1234",
+				"manufacturer":      "Vallox",
+				"name":              "Vallox",
+				"model":             "Digit SE 2",
+				"sw_version":        version,
+				"configuration_url": "http://vallox.local",
+			}},
+		},
+		{
+			name:   "broadcast entity does not expire",
+			setup:  func() { config.ExpireAfter = 10 * time.Minute },
+			uid:    "temp_incoming_outside",
+			absent: []string{"expire_after"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t)
+			tt.setup()
+
+			var msg map[string]any
+			if err := json.Unmarshal(discoveryMsg(tt.uid, "name", tt.state, tt.command), &msg); err != nil {
+				t.Fatalf("invalid json: %v", err)
+			}
+			for key, want := range tt.want {
+				if got := msg[key]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+			for _, key := range tt.absent {
+				if got, ok := msg[key]; ok {
+					t.Errorf("%s = %v, want none", key, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLockSerial(t *testing.T) {
+	tests := []struct {
+		name    string
+		pid     int
+		wantErr bool
+	}{
+		{"own lock", os.Getpid(), false},
+		{"held by running process", 1, true},
+		{"stale lock", 0x7ffffff0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t)
+			config.LockDir = t.TempDir()
+			device := "/dev/ttyTest"
+			if err := os.WriteFile(lockFile(device), []byte(fmt.Sprintf("%10d\n", tt.pid)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := lockSerial(device); (err != nil) != tt.wantErr {
+				t.Errorf("lockSerial() error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vallox_value",
+		Help: "Latest value received from Vallox by mqtt topic",
+	}, []string{"topic"})
+
+	metricSerialErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vallox_serial_errors_total",
+		Help: "Number of serial device errors",
+	})
+
+	metricMqttConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vallox_mqtt_connected",
+		Help: "1 if connected to mqtt broker, 0 otherwise",
+	})
+
+	metricMqttReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vallox_mqtt_reconnects_total",
+		Help: "Number of mqtt reconnect attempts",
+	})
+
+	metricPublishErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vallox_mqtt_publish_errors_total",
+		Help: "Number of failed mqtt publishes",
+	})
+)
+
+// Counters published to mqtt, for installations without Prometheus
+var (
+	countEvents        atomic.Int64
+	countPublished     atomic.Int64
+	countPublishErrors atomic.Int64
+	countSerialErrors  atomic.Int64
+	countReconnects    atomic.Int64
+)
+
+// startMetrics starts http server for Prometheus metrics if metrics address is configured
+func startMetrics() {
+	if config.MetricsAddr == "" {
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metricValue, metricSerialErrors, metricMqttConnected, metricMqttReconnects, metricPublishErrors)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	logInfo.Printf("serving metrics at %s/metrics", config.MetricsAddr)
+	go func() {
+		err := http.ListenAndServe(config.MetricsAddr, mux)
+		logError.Printf("metrics server stopped: %v", err)
+	}()
+}
+
+// updateMetric sets gauge for numeric value published to topic
+func updateMetric(topic string, value string) {
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		metricValue.WithLabelValues(topic).Set(number)
+	}
+}
+
+// publishCounters publishes diagnostic counters, counted since start of the process
+func publishCounters(mqtt mqttClient.Client) {
+	publishState(mqtt, topic(topicCounterEvents), strconv.FormatInt(countEvents.Load(), 10))
+	publishState(mqtt, topic(topicCounterPublished), strconv.FormatInt(countPublished.Load(), 10))
+	publishState(mqtt, topic(topicPublishErrors), strconv.FormatInt(countPublishErrors.Load(), 10))
+	publishState(mqtt, topic(topicSerialErrors), strconv.FormatInt(countSerialErrors.Load(), 10))
+	publishState(mqtt, topic(topicMqttReconnects), strconv.FormatInt(countReconnects.Load(), 10))
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestNtcTemperature(t *testing.T) {
+	tests := []struct {
+		raw  byte
+		want int16
+	}{
+		{0, -74},
+		{50, -18},
+		{100, 0},
+		{150, 16},
+		{200, 38},
+		{246, 97},
+		{247, 100},
+		{255, 100},
+	}
+	for _, tt := range tests {
+		if got := ntcTemperature(tt.raw); got != tt.want {
+			t.Errorf("ntcTemperature(%d) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestNtcTemperatureIncreasing(t *testing.T) {
+	for raw := 1; raw < len(ntcTable); raw++ {
+		if ntcTable[raw] < ntcTable[raw-1] {
+			t.Errorf("ntcTemperature(%d) = %d is lower than ntcTemperature(%d) = %d", raw, ntcTable[raw], raw-1, ntcTable[raw-1])
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	vallox "github.com/pvainio/vallox-rs485"
+)
+
+type persistedEntry struct {
+	Time  time.Time    `json:"time"`
+	Value vallox.Event `json:"value"`
+}
+
+// loadCache reads cache persisted by saveCache, empty cache is returned if there is none
+func loadCache() map[byte]cacheEntry {
+	cache := make(map[byte]cacheEntry)
+	if config.StatePath == "" {
+		return cache
+	}
+
+	content, err := os.ReadFile(config.StatePath)
+	if os.IsNotExist(err) {
+		return cache
+	} else if err != nil {
+		logError.Printf("cannot read state from %s: %v", config.StatePath, err)
+		return cache
+	}
+
+	persisted := make(map[byte]persistedEntry)
+	if err := json.Unmarshal(content, &persisted); err != nil {
+		logError.Printf("cannot parse state from %s: %v", config.StatePath, err)
+		return cache
+	}
+
+	for register, entry := range persisted {
+		cache[register] = cacheEntry{time: entry.Time, value: entry.Value}
+	}
+	logInfo.Printf("loaded %d values from %s", len(cache), config.StatePath)
+	return cache
+}
+
+// interval for saving changed values, values change several times a minute and
+// writing each change would wear SD cards of small devices
+const stateSaveInterval = time.Minute
+
+// cacheChanged is true when cache has changed since it was saved
+var cacheChanged bool
+
+// saveChangedCache saves cache if it has changed since the last save
+func saveChangedCache(cache map[byte]cacheEntry) {
+	if !cacheChanged {
+		return
+	}
+	cacheChanged = false
+	saveCache(cache)
+}
+
+// saveCache persists cache so that values can be published right after restart
+func saveCache(cache map[byte]cacheEntry) {
+	if config.StatePath == "" {
+		return
+	}
+
+	persisted := make(map[byte]persistedEntry)
+	for register, entry := range cache {
+		persisted[register] = persistedEntry{Time: entry.time, Value: entry.value}
+	}
+
+	content, err := json.Marshal(persisted)
+	if err != nil {
+		logError.Printf("cannot marshal state %v", err)
+		return
+	}
+
+	// write to temporary file first so that crash can't leave partial state
+	tmp := config.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		logError.Printf("cannot write state to %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, config.StatePath); err != nil {
+		logError.Printf("cannot write state to %s: %v", config.StatePath, err)
+	}
+}
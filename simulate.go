@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	vallox "github.com/pvainio/vallox-rs485"
+)
+
+// simulatedVallox emits plausible values without a real device, for testing
+// mqtt and Home Assistant setup before the rs485 wiring is done
+type simulatedVallox struct {
+	events chan vallox.Event
+	values map[byte]int16
+}
+
+func newSimulatedVallox() *simulatedVallox {
+	sim := &simulatedVallox{
+		events: make(chan vallox.Event, 50),
+		values: map[byte]int16{
+			vallox.FanSpeed:            3,
+			vallox.TempIncomingOutside: 2,
+			vallox.TempIncomingInside:  17,
+			vallox.TempOutgoingInside:  21,
+			vallox.TempOutgoingOutside: 5,
+			vallox.RhHighest:           45,
+			vallox.Rh1:                 45,
+			vallox.Rh2:                 40,
+			faultCode:                  0,
+		},
+	}
+
+	go sim.broadcast()
+
+	return sim
+}
+
+// broadcast emits temperatures regularly like Vallox does
+func (sim *simulatedVallox) broadcast() {
+	temps := []byte{vallox.TempIncomingOutside, vallox.TempIncomingInside, vallox.TempOutgoingInside, vallox.TempOutgoingOutside}
+	base := make(map[byte]int16)
+	for _, register := range temps {
+		base[register] = sim.values[register]
+	}
+
+	for range time.Tick(10 * time.Second) {
+		for _, register := range temps {
+			sim.emit(register, base[register]+int16(rand.Intn(3)-1))
+		}
+	}
+}
+
+func (sim *simulatedVallox) emit(register byte, value int16) {
+	sim.events <- vallox.Event{
+		Time:        time.Now(),
+		Source:      vallox.DeviceMain,
+		Destination: vallox.RemoteClientMulticast,
+		Register:    register,
+		RawValue:    byte(value),
+		Value:       value,
+	}
+}
+
+func (sim *simulatedVallox) Events() chan vallox.Event {
+	return sim.events
+}
+
+func (sim *simulatedVallox) ForMe(e vallox.Event) bool {
+	return true
+}
+
+func (sim *simulatedVallox) Query(register byte) {
+	if value, ok := sim.values[register]; ok {
+		go sim.emit(register, value)
+	}
+}
+
+func (sim *simulatedVallox) SetSpeed(speed byte) {
+	if speed < 1 || speed > 8 {
+		return
+	}
+	sim.values[vallox.FanSpeed] = int16(speed)
+	go sim.emit(vallox.FanSpeed, int16(speed))
+}